@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// The JSON API gives read only access to the database whilst the daemon
+// is running.  Each request reads in its own bolt.View transaction, which
+// doesn't block the scheduled checks from writing.  Caching headers are
+// derived from the snapshots each response is built from, so clients can
+// poll cheaply with If-None-Match or If-Modified-Since.
+//
+//	GET /api/days                        days with their products and sessions
+//	GET /api/days/<day>                  latest snapshot of each session on the day
+//	GET /api/days/<day>/sessions/<id>    every snapshot of a session
+//	GET /api/days/<day>/sessions/<id>/raw the booking site's JSON for each snapshot
+//	GET /api/products                    configured products and upcoming days
+//	GET /api/availability[?product=<id>] upcoming sessions and their spaces
+//	GET /api/upcoming[?days=<n>]         sessions in the next n days, including cancelled
+//	GET /api/changes                     stream of session changes, as server-sent events
+
+var (
+	errApiNotFound   = errors.New("not found")
+	errApiBadRequest = errors.New("bad request")
+)
+
+// apiDay is a day with ice, as listed by /api/days
+type apiDay struct {
+	Day       string
+	Products  []ProductId
+	Sessions  int
+	UpdatedAt time.Time
+}
+
+// apiSession is the latest snapshot of a session, with the bookings
+// worked out as in the summary
+type apiSession struct {
+	Day     string
+	Product ProductId
+	timestampedEventInfo
+	Snapshots int
+
+	// Booked and Capacity include the Academy's spaces, as for the
+	// calendar templates
+	Academy     int
+	Other       int
+	Booked      int
+	Capacity    int
+	BookingLink string
+}
+
+// apiSessionHistory is every snapshot of a session, oldest first
+type apiSessionHistory struct {
+	Day       string
+	Product   ProductId
+	SessionId string
+	Snapshots []timestampedEventInfo
+}
+
+// apiRawSnapshot is the JSON a snapshot was taken from, as it was sent.
+// Later JSON which differs only in fields we don't use shares the
+// snapshot's Sequence.
+type apiRawSnapshot struct {
+	Sequence  uint64
+	UpdatedAt time.Time
+	Payload   json.RawMessage
+}
+
+// apiProduct is a configured product, with the days it's available from
+// today onwards.  Only whether it's synced is given, as calendar ids and
+// collection urls (which may embed a token) aren't for everyone.
+type apiProduct struct {
+	Id           ProductId
+	GCalSync     bool
+	CalDAVSync   bool
+	UpcomingDays []string
+}
+
+// apiVersion tracks the snapshots a response is built from, to derive
+// its ETag and Last-Modified headers
+type apiVersion struct {
+	latest    time.Time
+	snapshots int
+
+	// keys hashes anything else the response depends on, such as the days
+	// and their products, which can change without a new snapshot
+	keys hash.Hash
+}
+
+func (av *apiVersion) saw(ev timestampedEventInfo, snapshots int) {
+	if ev.UpdatedAt.After(av.latest) {
+		av.latest = ev.UpdatedAt
+	}
+	av.snapshots += snapshots
+}
+
+// dependsOn adds values to those the response depends on
+func (av *apiVersion) dependsOn(values ...string) {
+	if av.keys == nil {
+		av.keys = sha256.New()
+	}
+	for _, v := range values {
+		av.keys.Write([]byte(v))
+		av.keys.Write([]byte{0})
+	}
+}
+
+// etag changes whenever a snapshot is added, one of the sessions
+// disappears, or anything else the response depends on changes.
+// Responses not built from snapshots use a hash of the body.
+func (av *apiVersion) etag(body []byte) string {
+	if av.snapshots == 0 && av.keys == nil {
+		return fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	}
+	tag := fmt.Sprintf(`"%x-%x`, av.latest.UnixNano(), av.snapshots)
+	if av.keys != nil {
+		tag += fmt.Sprintf("-%x", av.keys.Sum(nil)[:8])
+	}
+	return tag + `"`
+}
+
+// apiGetter builds a response from the database
+type apiGetter func(tx *bolt.Tx, r *http.Request, av *apiVersion) (interface{}, error)
+
+// apiHandler serves the JSON built by get, with caching headers
+func apiHandler(db *bolt.DB, get apiGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		av := &apiVersion{}
+		var resp interface{}
+		err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			resp, err = get(tx, r, av)
+			return err
+		})
+		if err == errApiNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err == errApiBadRequest {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			slog.Error("Can't serve API request", "path", r.URL.Path, "err", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+
+		body, err := json.MarshalIndent(resp, "", "  ")
+		if err != nil {
+			slog.Error("Can't marshal API response", "path", r.URL.Path, "err", err)
+			http.Error(w, "encoding error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("ETag", av.etag(body))
+		http.ServeContent(w, r, "", av.latest, bytes.NewReader(body))
+	}
+}
+
+// handleApi registers the API's handlers
+func handleApi(mux *http.ServeMux, db *bolt.DB) {
+	mux.HandleFunc("/api/days", apiHandler(db, apiDays))
+	mux.HandleFunc("/api/days/", apiHandler(db, apiDayOrSession))
+	mux.HandleFunc("/api/products", apiHandler(db, apiProducts))
+	mux.HandleFunc("/api/availability", apiHandler(db, apiAvailability))
+	mux.HandleFunc("/api/upcoming", apiHandler(db, apiUpcoming))
+}
+
+func apiDays(tx *bolt.Tx, r *http.Request, av *apiVersion) (interface{}, error) {
+	days := []apiDay{}
+	av.dependsOn(strconv.FormatUint(latestCursor(tx), 10))
+	err := tx.ForEach(func(day []byte, b *bolt.Bucket) error {
+		if !isDayKey(day) {
+			return nil
+		}
+
+		d := apiDay{Day: string(day), Products: []ProductId{}}
+		json.Unmarshal(b.Get([]byte("products")), &d.Products)
+		av.dependsOn(string(day), string(b.Get([]byte("products"))))
+
+		if evs := b.Bucket([]byte("events")); evs != nil {
+			err := evs.ForEach(func(sid, _ []byte) error {
+				sb := evs.Bucket(sid)
+				ev, err := getMostRecentDetails(sb)
+				if err == ErrNoSuchEvent {
+					return nil
+				} else if err != nil {
+					return err
+				}
+
+				d.Sessions++
+				if ev.UpdatedAt.After(d.UpdatedAt) {
+					d.UpdatedAt = ev.UpdatedAt
+				}
+				av.saw(ev, sb.Stats().KeyN)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		days = append(days, d)
+		return nil
+	})
+	return days, err
+}
+
+// apiDayOrSession serves /api/days/<day> and /api/days/<day>/sessions/<id>
+func apiDayOrSession(tx *bolt.Tx, r *http.Request, av *apiVersion) (interface{}, error) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/days/"), "/")
+	day := path[0]
+	if !isDayKey([]byte(day)) || tx.Bucket([]byte(day)) == nil {
+		return nil, errApiNotFound
+	}
+
+	switch {
+	case len(path) == 1:
+		return apiDaySessions(tx, day, av)
+	case len(path) == 3 && path[1] == "sessions":
+		return apiSessionSnapshots(tx, day, path[2], av)
+	case len(path) == 4 && path[1] == "sessions" && path[3] == "raw":
+		return apiSessionRaw(tx, day, path[2], av)
+	default:
+		return nil, errApiNotFound
+	}
+}
+
+func apiDaySessions(tx *bolt.Tx, day string, av *apiVersion) (interface{}, error) {
+	stored, err := latestSessions(tx, day, day)
+	if err != nil {
+		return nil, err
+	}
+	return apiSessions(stored, av), nil
+}
+
+// apiSessions converts stored sessions, sorted by start time
+func apiSessions(stored []storedSession, av *apiVersion) []apiSession {
+	sessions := []apiSession{}
+	for _, s := range stored {
+		snapshots := len(s.History) + 1
+		av.saw(s.Event, snapshots)
+		data := newEventTemplateData(s.Event, s.EventContext)
+		sessions = append(sessions, apiSession{
+			Day:                  s.Day,
+			Product:              s.Product,
+			timestampedEventInfo: s.Event,
+			Snapshots:            snapshots,
+			Academy:              data.Academy,
+			Other:                data.Other,
+			Booked:               data.Booked,
+			Capacity:             data.Capacity,
+			BookingLink:          data.BookingLink,
+		})
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if sessions[i].Day != sessions[j].Day {
+			return sessions[i].Day < sessions[j].Day
+		}
+		return sessions[i].StartTime < sessions[j].StartTime
+	})
+	return sessions
+}
+
+func apiSessionSnapshots(tx *bolt.Tx, day, sid string, av *apiVersion) (interface{}, error) {
+	b := tx.Bucket([]byte(day))
+	evs := b.Bucket([]byte("events"))
+	if evs == nil || evs.Bucket([]byte(sid)) == nil {
+		return nil, errApiNotFound
+	}
+
+	history, err := getHistory(evs.Bucket([]byte(sid)))
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, errApiNotFound
+	}
+
+	productsAvailable := []ProductId{}
+	json.Unmarshal(b.Get([]byte("products")), &productsAvailable)
+
+	latest := history[len(history)-1]
+	av.saw(latest, len(history))
+
+	return apiSessionHistory{
+		Day:       day,
+		Product:   sessionProduct(productsAvailable, latest),
+		SessionId: sid,
+		Snapshots: history,
+	}, nil
+}
+
+func apiSessionRaw(tx *bolt.Tx, day, sid string, av *apiVersion) (interface{}, error) {
+	evs := tx.Bucket([]byte(day)).Bucket([]byte("events"))
+	if evs == nil || evs.Bucket([]byte(sid)) == nil {
+		return nil, errApiNotFound
+	}
+
+	history, err := getHistory(evs.Bucket([]byte(sid)))
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, errApiNotFound
+	}
+	av.saw(history[len(history)-1], len(history))
+
+	payloads, err := rawPayloads(tx, day, sid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Payloads can change without a new snapshot
+	av.dependsOn(strconv.Itoa(len(payloads)))
+
+	// Snapshots are numbered from 1, in order
+	raw := []apiRawSnapshot{}
+	for _, p := range payloads {
+		if p.Snapshot < 1 || p.Snapshot > uint64(len(history)) {
+			continue
+		}
+		seen := p.Changed
+		if seen.IsZero() {
+			seen = history[p.Snapshot-1].UpdatedAt
+		}
+		raw = append(raw, apiRawSnapshot{p.Snapshot, seen, p.Payload})
+	}
+	return raw, nil
+}
+
+func apiProducts(tx *bolt.Tx, r *http.Request, av *apiVersion) (interface{}, error) {
+	prods := []apiProduct{}
+	for pid, prodCfg := range productsMap {
+		prods = append(prods, apiProduct{Id: pid, GCalSync: prodCfg.GCal != "", CalDAVSync: prodCfg.CalDAV != "", UpcomingDays: []string{}})
+	}
+	sort.Slice(prods, func(i, j int) bool { return prods[i].Id < prods[j].Id })
+
+	c := tx.Cursor()
+	for day, _ := c.Seek([]byte(apiToday())); day != nil; day, _ = c.Next() {
+		if !isDayKey(day) {
+			continue
+		}
+
+		productsAvailable := []ProductId{}
+		json.Unmarshal(tx.Bucket(day).Get([]byte("products")), &productsAvailable)
+		for _, pid := range productsAvailable {
+			for i := range prods {
+				if prods[i].Id == pid {
+					prods[i].UpcomingDays = append(prods[i].UpcomingDays, string(day))
+				}
+			}
+		}
+	}
+
+	return prods, nil
+}
+
+// apiAvailability serves the latest snapshot of every session from today
+// onwards which hasn't been cancelled, optionally for just one product
+func apiAvailability(tx *bolt.Tx, r *http.Request, av *apiVersion) (interface{}, error) {
+	stored, err := latestSessions(tx, apiToday(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	product := ProductId(r.URL.Query().Get("product"))
+
+	var current []storedSession
+	for _, s := range stored {
+		if s.Event.Cancelled || (product != "" && s.Product != product) {
+			continue
+		}
+		current = append(current, s)
+	}
+
+	return apiSessions(current, av), nil
+}
+
+// DefaultUpcomingDays is the number of days shown on the dashboard
+const DefaultUpcomingDays = 14
+
+// apiUpcoming serves the latest snapshot of every session in the coming
+// days, including those which have been cancelled
+func apiUpcoming(tx *bolt.Tx, r *http.Request, av *apiVersion) (interface{}, error) {
+	days := DefaultUpcomingDays
+	if d := r.URL.Query().Get("days"); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil || days < 1 {
+			return nil, errApiBadRequest
+		}
+	}
+
+	last := time.Now().AddDate(0, 0, days-1).Format("2006-01-02")
+	stored, err := latestSessions(tx, apiToday(), last)
+	if err != nil {
+		return nil, err
+	}
+	return apiSessions(stored, av), nil
+}
+
+func apiToday() string {
+	return time.Now().Format("2006-01-02")
+}
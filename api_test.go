@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func apiDaysETag(t *testing.T, db *bolt.DB) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	apiHandler(db, apiDays)(w, httptest.NewRequest(http.MethodGet, "/api/days", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/api/days gave %v", w.Code)
+	}
+	return w.Header().Get("ETag")
+}
+
+func TestApiDaysETag(t *testing.T) {
+	db, day := newTestDay(t, "prod-a")
+	first := apiDaysETag(t, db)
+	if again := apiDaysETag(t, db); again != first {
+		t.Errorf("ETag changed from %v to %v without any change", first, again)
+	}
+
+	// Neither of these adds a snapshot
+	for _, change := range []struct {
+		name   string
+		update func(tx *bolt.Tx) error
+	}{
+		{"products changed", func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(day)).Put([]byte("products"), []byte(`["prod-a","prod-b"]`))
+		}},
+		{"day added", func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("2099-01-01"))
+			return err
+		}},
+	} {
+		if err := db.Update(change.update); err != nil {
+			t.Fatal(err)
+		}
+		etag := apiDaysETag(t, db)
+		if etag == first {
+			t.Errorf("%v: ETag still %v", change.name, etag)
+		}
+		first = etag
+	}
+}
+
+func TestApiProductsHidesCalendars(t *testing.T) {
+	useProducts(t, map[ProductId]ProductConfig{
+		"prod-a": {GCal: "secret@group.calendar.google.com", CalDAV: "https://dav.example.com/cal/token-123/"},
+	})
+	db, _ := newTestDay(t, "prod-a")
+
+	w := httptest.NewRecorder()
+	apiHandler(db, apiProducts)(w, httptest.NewRequest(http.MethodGet, "/api/products", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || strings.Contains(body, "secret@") || strings.Contains(body, "token-123") {
+		t.Errorf("/api/products gave %v: %v", w.Code, body)
+	}
+	if !strings.Contains(body, `"GCalSync": true`) || !strings.Contains(body, `"CalDAVSync": true`) {
+		t.Errorf("/api/products doesn't say the product is synced: %v", body)
+	}
+}
+
+func TestApiSessionBookings(t *testing.T) {
+	useProducts(t, map[ProductId]ProductConfig{"prod-a": {}})
+	db := openTestDb(t)
+	ev, evCtx := testSession(60)
+	ev.CapacityFreeAcademy, ev.AvailableFreeSpaces = 20, 10
+	putTestSnapshots(t, db, evCtx.Day, evCtx.Product, ev)
+
+	w := httptest.NewRecorder()
+	apiHandler(db, apiDayOrSession)(w, httptest.NewRequest(http.MethodGet, "/api/days/"+evCtx.Day, nil))
+	var sessions []apiSession
+	if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil || len(sessions) != 1 {
+		t.Fatalf("/api/days/%v gave %v (%v): %v", evCtx.Day, w.Code, err, w.Body)
+	}
+	// The dashboard's bar and counts both use these, Academy included
+	if s := sessions[0]; s.Academy != 10 || s.Other != 40 || s.Booked != 50 || s.Capacity != 120 {
+		t.Errorf("bookings %v Academy, %v other, %v of %v, want 10, 40, 50 of 120", s.Academy, s.Other, s.Booked, s.Capacity)
+	}
+}
@@ -2,12 +2,26 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 )
 
+// bookingClient makes requests to the booking site, noting the shape of
+// its responses in schema
+type bookingClient struct {
+	*http.Client
+	schema *schemaObserver
+}
+
+// newBookingClient returns a client for a run of a check, which records
+// metrics
+func newBookingClient() bookingClient {
+	return bookingClient{instrumentedClient(), newSchemaObserver()}
+}
+
 // The ice-sports calendar provides information about event availability on
 // each day of the specified month, for a specific product.  It also contains
 // entries for additional days either side of the specified month, so as to
@@ -33,7 +47,7 @@ const baseMonthUrl = "https://bookings.national-ice-centre.com/booking/ice-sport
 
 // getCalendar retrieves the calendar information for the specified month and product
 // returning a pointer to the imported data structure
-func getCalendar(c *http.Client, month time.Month, year int, product ProductId) (*Calendar, error) {
+func getCalendar(c bookingClient, month time.Month, year int, product ProductId) (*Calendar, error) {
 	u, err := url.Parse(baseMonthUrl)
 	if err != nil {
 		return nil, err
@@ -57,9 +71,13 @@ func getCalendar(c *http.Client, month time.Month, year int, product ProductId)
 	}
 	defer resp.Body.Close()
 
-	dec := json.NewDecoder(resp.Body)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	cal := Calendar{}
-	if err := dec.Decode(&cal); err != nil {
+	if err := c.schema.decodeStrictly("ice-sports-calendar", data, &cal); err != nil {
 		return nil, err
 	}
 
@@ -68,9 +86,30 @@ func getCalendar(c *http.Client, month time.Month, year int, product ProductId)
 
 // EventsInfo is an array of structures representing events
 // which exist on the specified day for the specified productId
-// Much of the information provided over the API is ignored, as not relevant.
+// Much of the information provided over the API is ignored, as not relevant,
+// but the whole of each event's object is kept in raw.
 type EventsInfo []EventInfo
 
+// UnmarshalJSON keeps each event's JSON object as it was sent.  It's on
+// the list rather than EventInfo, as EventInfo is embedded in the stored
+// snapshots, which would otherwise be decoded by it too.
+func (ei *EventsInfo) UnmarshalJSON(data []byte) error {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return err
+	}
+
+	events := make(EventsInfo, len(raws))
+	for i, raw := range raws {
+		if err := json.Unmarshal(raw, &events[i]); err != nil {
+			return err
+		}
+		events[i].raw = raw
+	}
+	*ei = events
+	return nil
+}
+
 type EventInfo struct {
 	SessionId   string
 	ProductName string
@@ -82,13 +121,16 @@ type EventInfo struct {
 	AvailableSpaces     int
 	CapacityFreeAcademy int
 	AvailableFreeSpaces int
+
+	// The event's JSON object as sent, which isn't stored with the rest
+	raw json.RawMessage
 }
 
 const baseEventTimesUrl = "https://bookings.national-ice-centre.com/booking/ice-sports-times"
 
 // getEventTimes retrieves the list of event  information for the specified day and product
 // returning a pointer to the imported data structure
-func getEventsInfo(c *http.Client, date string, product ProductId) (*EventsInfo, error) {
+func getEventsInfo(c bookingClient, date string, product ProductId) (*EventsInfo, error) {
 	u, err := url.Parse(baseEventTimesUrl)
 	if err != nil {
 		return nil, err
@@ -111,9 +153,13 @@ func getEventsInfo(c *http.Client, date string, product ProductId) (*EventsInfo,
 	}
 	defer resp.Body.Close()
 
-	dec := json.NewDecoder(resp.Body)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	ei := EventsInfo{}
-	if err := dec.Decode(&ei); err != nil {
+	if err := c.schema.decodeStrictly("ice-sports-times", data, &ei); err != nil {
 		return nil, err
 	}
 
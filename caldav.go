@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// CalDAV calendars (e.g. Nextcloud) are an alternative to Google Calendar.
+// Each session is stored as its own calendar object resource within the
+// collection, named after the session's event id.  See:
+// https://tools.ietf.org/html/rfc4791#section-5.3.2
+//
+// Updates are conditional on the ETag we last saw for the resource, which
+// is kept in the database so that each update is a single request:
+// /caldav-etags/<resource url>:<etag>
+//
+// If the resource has been changed by someone else, it's left alone and
+// marked as conflicting until caldav-resolve is run for it, at which
+// point it's overwritten on the next push:
+// /caldav-conflicts/<resource url>:<time detected>
+
+var CalDAVClient *http.Client
+
+// caldavUser and caldavPassword are used for basic authentication
+var caldavUser, caldavPassword string
+
+func setupCaldavSync() {
+	// Credentials are optional, as the collection url may embed a token
+	caldavUser = os.Getenv("ICESCRAPER_CALDAV_USER")
+	caldavPassword = os.Getenv("ICESCRAPER_CALDAV_PASSWORD")
+
+	for _, prodCfg := range productsMap {
+		if prodCfg.CalDAV != "" {
+			CalDAVClient = &http.Client{Transport: metricsTransport{"caldav", http.DefaultTransport}}
+			return
+		}
+	}
+}
+
+var caldavETagBucket = []byte("caldav-etags")
+
+// caldavSink publishes sessions to a CalDAV collection
+type caldavSink struct {
+	client     *http.Client
+	collection string
+	tx         *bolt.Tx
+}
+
+func newCaldavSink(c *http.Client, collection string, tx *bolt.Tx) caldavSink {
+	if !strings.HasSuffix(collection, "/") {
+		collection += "/"
+	}
+	return caldavSink{c, collection, tx}
+}
+
+func (cs caldavSink) Target() string {
+	return caldavTargetPrefix + cs.collection
+}
+
+func (cs caldavSink) PublishEvent(ev timestampedEventInfo, evCtx EventContext, sequence uint64) error {
+	buf := &bytes.Buffer{}
+	iw := &icsWriter{w: buf}
+	iw.line("BEGIN:VCALENDAR")
+	iw.line("VERSION:2.0")
+	iw.line("PRODID:" + icsProdId)
+	if err := writeVEvent(iw, ev, evCtx, sequence); err != nil {
+		return errors.Wrap(err, "converting calendar event")
+	}
+	iw.line("END:VCALENDAR")
+
+	url := cs.collection + sessionEventId(ev.SessionId) + ".ics"
+	if cs.conflicted(url) {
+		return errCaldavConflict
+	}
+
+	// The ETag is only fetched for resources we've not stored before, or
+	// whose ETag the server didn't tell us
+	etag := cs.storedETag(url)
+	if etag == "" {
+		var err error
+		if etag, err = cs.fetchETag(url); err != nil {
+			return err
+		}
+	}
+
+	newTag, err := cs.put(url, etag, buf.Bytes())
+	if err == errCaldavConflict {
+		// The resource has been changed by someone else since we stored
+		// it, so the update fails, and is queued and reported, until the
+		// conflict is resolved by hand
+		sessionLogger(evCtx.Day, evCtx.Product, ev.SessionId).Warn("CalDAV object changed on the server, run caldav-resolve to overwrite it", "url", url)
+		if storeErr := cs.storeConflict(url); storeErr != nil {
+			return storeErr
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	return cs.storeETag(url, newTag)
+}
+
+var errCaldavConflict = errors.New("calendar object changed on the server, run caldav-resolve to overwrite it")
+
+var caldavConflictBucket = []byte("caldav-conflicts")
+
+// conflicted reports whether the resource has been found to be changed by
+// someone else, and not yet resolved
+func (cs caldavSink) conflicted(url string) bool {
+	if cs.tx == nil {
+		return false
+	}
+	b := cs.tx.Bucket(caldavConflictBucket)
+	return b != nil && b.Get([]byte(url)) != nil
+}
+
+func (cs caldavSink) storeConflict(url string) error {
+	if cs.tx == nil || !cs.tx.Writable() {
+		return nil
+	}
+	b, err := cs.tx.CreateBucketIfNotExists(caldavConflictBucket)
+	if err != nil {
+		return errors.Wrap(err, "creating CalDAV conflict bucket")
+	}
+	return errors.Wrap(b.Put([]byte(url), []byte(time.Now().Format(time.RFC3339))), "storing CalDAV conflict")
+}
+
+// resolveCaldavConflicts lets us overwrite the given resources, or all of
+// those in conflict if none are given, on their next push
+func resolveCaldavConflicts(db *bolt.DB, urls []string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(caldavConflictBucket)
+		if b == nil {
+			return nil
+		}
+		if len(urls) == 0 {
+			b.ForEach(func(k, _ []byte) error {
+				urls = append(urls, string(k))
+				return nil
+			})
+		}
+
+		etags := tx.Bucket(caldavETagBucket)
+		for _, url := range urls {
+			if b.Get([]byte(url)) == nil {
+				return errors.Errorf("%v isn't in conflict", url)
+			}
+			if err := b.Delete([]byte(url)); err != nil {
+				return errors.Wrap(err, "removing CalDAV conflict")
+			}
+			// The next push fetches the server's ETag, to replace its version
+			if etags != nil {
+				if err := etags.Delete([]byte(url)); err != nil {
+					return errors.Wrap(err, "removing CalDAV ETag")
+				}
+			}
+			slog.Info("CalDAV conflict resolved, the object will be overwritten", "url", url)
+		}
+		return nil
+	})
+}
+
+// storedETag returns the ETag of the resource when we last stored it, or
+// an empty string if it's not known
+func (cs caldavSink) storedETag(url string) string {
+	if cs.tx == nil {
+		return ""
+	}
+	if b := cs.tx.Bucket(caldavETagBucket); b != nil {
+		return string(b.Get([]byte(url)))
+	}
+	return ""
+}
+
+// storeETag remembers the resource's ETag, or forgets it if it's empty
+func (cs caldavSink) storeETag(url, etag string) error {
+	if cs.tx == nil || !cs.tx.Writable() {
+		return nil
+	}
+	b, err := cs.tx.CreateBucketIfNotExists(caldavETagBucket)
+	if err != nil {
+		return errors.Wrap(err, "creating CalDAV ETag bucket")
+	}
+	if etag == "" {
+		return errors.Wrap(b.Delete([]byte(url)), "removing CalDAV ETag")
+	}
+	return errors.Wrap(b.Put([]byte(url), []byte(etag)), "storing CalDAV ETag")
+}
+
+// put stores the calendar object, conditional on it being unchanged since
+// we saw etag, or on it not existing if etag is empty.  The object's new
+// ETag is returned, if the server gives it.
+func (cs caldavSink) put(url, etag string, data []byte) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return "", errors.Wrap(err, "creating put request")
+	}
+	req.Header.Set("Content-Type", "text/calendar; charset=utf-8")
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	} else {
+		req.Header.Set("If-None-Match", "*")
+	}
+	cs.authorise(req)
+
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "putting calendar object")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		// Not all servers return the new ETag, in which case we'll
+		// need to fetch it before the next update
+		return resp.Header.Get("ETag"), nil
+	case http.StatusPreconditionFailed:
+		return "", errCaldavConflict
+	default:
+		return "", errors.Errorf("putting calendar object: %v %s", resp.Status, body)
+	}
+}
+
+// fetchETag returns the current ETag of a calendar object, or an empty
+// string if it doesn't exist yet
+func (cs caldavSink) fetchETag(url string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "creating head request")
+	}
+	cs.authorise(req)
+
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "fetching calendar object")
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			return "", errors.New("calendar object has no ETag")
+		}
+		return etag, nil
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", errors.Errorf("fetching calendar object: %v", resp.Status)
+	}
+}
+
+func (cs caldavSink) authorise(req *http.Request) {
+	if caldavUser != "" {
+		req.SetBasicAuth(caldavUser, caldavPassword)
+	}
+}
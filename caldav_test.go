@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// fakeCaldav is a CalDAV collection which honours conditional requests
+type fakeCaldav struct {
+	sync.Mutex
+	objects  map[string]string // path to body
+	etags    map[string]string
+	version  int
+	noETags  bool // as some servers don't return the ETag of a put
+	failWith int  // status returned to puts, if set
+	requests []string
+}
+
+func newFakeCaldav(t *testing.T) (*fakeCaldav, *httptest.Server) {
+	fc := &fakeCaldav{objects: map[string]string{}, etags: map[string]string{}}
+	srv := httptest.NewServer(fc)
+	t.Cleanup(srv.Close)
+	return fc, srv
+}
+
+func (fc *fakeCaldav) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	cond := r.Header.Get("If-Match")
+	if r.Header.Get("If-None-Match") != "" {
+		cond = "If-None-Match:" + r.Header.Get("If-None-Match")
+	}
+	fc.requests = append(fc.requests, r.Method+" "+cond)
+
+	etag, exists := fc.etags[r.URL.Path]
+	switch r.Method {
+	case http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag)
+	case http.MethodPut:
+		if fc.failWith != 0 {
+			w.WriteHeader(fc.failWith)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists ||
+			r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fc.change(r.URL.Path, string(body))
+		if !fc.noETags {
+			w.Header().Set("ETag", fc.etags[r.URL.Path])
+		}
+		if exists {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// change stores an object as if by another writer, giving it a new ETag
+func (fc *fakeCaldav) change(path, body string) {
+	fc.version++
+	fc.objects[path] = body
+	fc.etags[path] = fmt.Sprintf(`"%d"`, fc.version)
+}
+
+// takeRequests returns the requests made since last called
+func (fc *fakeCaldav) takeRequests() []string {
+	fc.Lock()
+	defer fc.Unlock()
+	reqs := fc.requests
+	fc.requests = nil
+	return reqs
+}
+
+// publishCaldav pushes the session to the collection in its own transaction
+func publishCaldav(t *testing.T, db *bolt.DB, collection string, ev timestampedEventInfo, evCtx EventContext, seq uint64) error {
+	t.Helper()
+	var pubErr error
+	if err := db.Update(func(tx *bolt.Tx) error {
+		pubErr = newCaldavSink(http.DefaultClient, collection, tx).PublishEvent(ev, evCtx, seq)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return pubErr
+}
+
+func TestCaldavCreateAndUpdate(t *testing.T) {
+	for _, noETags := range []bool{false, true} {
+		fc, srv := newFakeCaldav(t)
+		fc.noETags = noETags
+		db := openTestDb(t)
+		collection := srv.URL + "/cal"
+
+		ev, evCtx := testSession(40)
+		if err := publishCaldav(t, db, collection, ev, evCtx, 0); err != nil {
+			t.Fatal(err)
+		}
+		// A new object is only created if it doesn't exist
+		if got, want := fc.takeRequests(), []string{"HEAD ", "PUT If-None-Match:*"}; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("noETags %v: creating made %q, want %q", noETags, got, want)
+		}
+
+		ev.AvailableSpaces = 30
+		ev.Cancelled = true
+		if err := publishCaldav(t, db, collection, ev, evCtx, 1); err != nil {
+			t.Fatal(err)
+		}
+		// The update is conditional on the object being unchanged, and
+		// only needs to fetch its ETag if the server didn't give it
+		want := []string{`PUT "1"`}
+		if noETags {
+			want = []string{"HEAD ", `PUT "1"`}
+		}
+		if got := fc.takeRequests(); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("noETags %v: updating made %q, want %q", noETags, got, want)
+		}
+
+		// Cancelled sessions are kept in the calendar, marked as such
+		body := fc.objects["/cal/"+sessionEventId(ev.SessionId)+".ics"]
+		for _, w := range []string{"\r\nSEQUENCE:1\r\n", "\r\nSTATUS:CANCELLED\r\n", "\r\nDESCRIPTION:0 Academy\\, 70 other booked"} {
+			if !strings.Contains(body, w) {
+				t.Errorf("noETags %v: object doesn't contain %q:\n%v", noETags, w, body)
+			}
+		}
+	}
+}
+
+func TestCaldavConflictKeptUntilResolved(t *testing.T) {
+	fc, srv := newFakeCaldav(t)
+	db := openTestDb(t)
+	collection := srv.URL + "/cal"
+	path := "/cal/" + sessionEventId("12345") + ".ics"
+
+	ev, evCtx := testSession(40)
+	if err := publishCaldav(t, db, collection, ev, evCtx, 0); err != nil {
+		t.Fatal(err)
+	}
+	fc.change(path, "someone else's")
+	fc.takeRequests()
+
+	ev.AvailableSpaces = 30
+	if err := publishCaldav(t, db, collection, ev, evCtx, 1); err != errCaldavConflict {
+		t.Fatalf("publishing over a changed object gave %v", err)
+	}
+	if got := fc.takeRequests(); fmt.Sprint(got) != `[PUT "1"]` {
+		t.Errorf("conflicting update made %q", got)
+	}
+
+	// Later pushes don't overwrite the other change
+	if err := publishCaldav(t, db, collection, ev, evCtx, 2); err != errCaldavConflict {
+		t.Errorf("publishing while in conflict gave %v", err)
+	}
+	if got := fc.takeRequests(); len(got) != 0 {
+		t.Errorf("publishing while in conflict made %q", got)
+	}
+	if fc.objects[path] != "someone else's" {
+		t.Errorf("other change overwritten")
+	}
+
+	if err := resolveCaldavConflicts(db, []string{"http://elsewhere/x.ics"}); err == nil {
+		t.Errorf("resolved an object which isn't in conflict")
+	}
+	if err := resolveCaldavConflicts(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once resolved, the object is overwritten
+	if err := publishCaldav(t, db, collection, ev, evCtx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := fc.takeRequests(); fmt.Sprint(got) != `[HEAD  PUT "2"]` {
+		t.Errorf("resolved update made %q", got)
+	}
+	if !strings.Contains(fc.objects[path], "SEQUENCE:2") {
+		t.Errorf("object not overwritten:\n%v", fc.objects[path])
+	}
+}
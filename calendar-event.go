@@ -1,17 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"encoding/base32"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/boltdb/bolt"
 	"github.com/pkg/errors"
 )
 
@@ -35,8 +37,34 @@ type GCalEvent struct {
 		DateTime time.Time `json:"dateTime,omitempty"`
 	} `json:"end,omitempty"`
 	Status string `json:"status,omitempty"`
+
+	ColorId            string                  `json:"colorId,omitempty"`
+	Reminders          *GCalReminders          `json:"reminders,omitempty"`
+	ExtendedProperties *GCalExtendedProperties `json:"extendedProperties,omitempty"`
+}
+
+type GCalReminders struct {
+	UseDefault bool           `json:"useDefault"`
+	Overrides  []GCalReminder `json:"overrides,omitempty"`
+}
+
+// GCalReminder is a reminder, where Method is "email" or "popup"
+type GCalReminder struct {
+	Method  string `json:"method"`
+	Minutes int    `json:"minutes"`
+}
+
+type GCalExtendedProperties struct {
+	Private map[string]string `json:"private,omitempty"`
 }
 
+// These private extended properties record which session and product
+// an event was created from, so our events can be found reliably
+const (
+	sessionIdProperty = "iceScraperSessionId"
+	productIdProperty = "iceScraperProductId"
+)
+
 // referenceDate is a parse string to let us parse the
 // day and time taken from the ice schedule
 // day is written in 2006-01-02 format,
@@ -53,7 +81,7 @@ func initialiseLocalTimezone() {
 		var err error
 		localTimezone, err = time.LoadLocation("Europe/London")
 		if err != nil {
-			log.Println("Can't load timezone, defaulting to UTC")
+			slog.Warn("Can't load timezone, defaulting to UTC")
 			localTimezone = time.UTC
 		}
 	}
@@ -75,12 +103,32 @@ func makeProductLink(productId ProductId) string {
 		base64.RawURLEncoding.EncodeToString([]byte(productId)))
 }
 
+// sessionEventId returns the calendar event id used for a session
+func sessionEventId(sessionId string) string {
+	return strings.ToLower(idEncoder.EncodeToString([]byte(sessionId)))
+}
+
+// sessionIdFromEventId reverses sessionEventId, returning false if the
+// event id can't have been made by this application
+func sessionIdFromEventId(eventId string) (string, bool) {
+	sid, err := idEncoder.DecodeString(strings.ToUpper(eventId))
+	if err != nil || len(sid) == 0 || !utf8.Valid(sid) {
+		return "", false
+	}
+	for _, r := range string(sid) {
+		if !unicode.IsPrint(r) {
+			return "", false
+		}
+	}
+	return string(sid), true
+}
+
 func makeGCalEvent(ev timestampedEventInfo, evCtx EventContext) (*GCalEvent, error) {
 	// Make sure the timezone is initialised
 	initialiseLocalTimezone()
 
 	newEvent := GCalEvent{
-		Id:       strings.ToLower(idEncoder.EncodeToString([]byte(ev.SessionId))),
+		Id:       sessionEventId(ev.SessionId),
 		Summary:  ev.ProductName,
 		Location: ev.Location,
 		Description: fmt.Sprintf("%v Academy, %v other booked\n%v\nLast updated: %v\n",
@@ -106,25 +154,48 @@ func makeGCalEvent(ev timestampedEventInfo, evCtx EventContext) (*GCalEvent, err
 		newEvent.Status = "cancelled"
 	}
 
+	newEvent.ExtendedProperties = &GCalExtendedProperties{
+		Private: map[string]string{
+			sessionIdProperty: ev.SessionId,
+			productIdProperty: string(evCtx.Product),
+		},
+	}
+
+	prodCfg := productsMap[evCtx.Product]
+	if err := prodCfg.Templates.apply(&newEvent, newEventTemplateData(ev, evCtx)); err != nil {
+		return nil, err
+	}
+
+	newEvent.ColorId = prodCfg.ColorId
+	if len(prodCfg.Reminders) > 0 {
+		newEvent.Reminders = &GCalReminders{Overrides: prodCfg.Reminders}
+	}
+
 	return &newEvent, nil
 }
 
+// gcalApiBase is where Calendar API requests are sent, which can be
+// changed with setGcalApiRoot
+var gcalApiBase = "https://www.googleapis.com/calendar/v3"
+
 func insertCalendarEvent(c *http.Client, calendarId string, ev *GCalEvent) error {
 	data, err := json.Marshal(ev)
 	if err != nil {
 		return errors.Wrap(err, "marshalling new event")
 	}
 
-	url := fmt.Sprintf("https://www.googleapis.com/calendar/v3/calendars/%v/events", calendarId)
+	url := fmt.Sprintf("%v/calendars/%v/events", gcalApiBase, calendarId)
 
-	resp, err := c.Post(url, "application/json", bytes.NewReader(data))
-	if err != nil {
+	jsonData, err := gcalDo(c, http.MethodPost, url, data)
+	if apiErr, ok := err.(*GoogleAPIError); ok && apiErr.Duplicate() {
+		// The id is already in use, perhaps by an event deleted by hand,
+		// so update that instead
+		slog.Info("Calendar event already exists, updating", "calendar", calendarId, "event", ev.Id)
+		return updateCalendarEvent(c, calendarId, ev)
+	} else if err != nil {
 		return errors.Wrap(err, "inserting event")
 	}
 
-	jsonData, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-
 	newEvent := GCalEvent{}
 	if err := json.Unmarshal(jsonData, &newEvent); err != nil {
 		return errors.Wrap(err, "parsing inserted event")
@@ -133,34 +204,59 @@ func insertCalendarEvent(c *http.Client, calendarId string, ev *GCalEvent) error
 	return nil
 }
 
-var ErrNotFound = errors.New("Not found")
+// listCalendarEvents returns all events in the calendar which overlap the
+// given time range, including those which have been cancelled
+func listCalendarEvents(c *http.Client, calendarId string, timeMin, timeMax time.Time) ([]GCalEvent, error) {
+	var events []GCalEvent
 
-func updateCalendarEvent(c *http.Client, calendarId string, ev *GCalEvent) error {
-	data, err := json.Marshal(ev)
-	if err != nil {
-		return errors.Wrap(err, "marshalling new event")
-	}
+	query := url.Values{}
+	query.Set("timeMin", timeMin.Format(time.RFC3339))
+	query.Set("timeMax", timeMax.Format(time.RFC3339))
+	query.Set("showDeleted", "true")
+	query.Set("singleEvents", "true")
+	query.Set("maxResults", "2500")
 
-	url := fmt.Sprintf("https://www.googleapis.com/calendar/v3/calendars/%v/events/%v", calendarId, ev.Id)
+	for {
+		u := fmt.Sprintf("%v/calendars/%v/events?%v", gcalApiBase, calendarId, query.Encode())
 
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
-	if err != nil {
-		return errors.Wrap(err, "creating put request")
+		jsonData, err := gcalDo(c, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "listing events")
+		}
+
+		var page struct {
+			Items         []GCalEvent
+			NextPageToken string
+		}
+		if err := json.Unmarshal(jsonData, &page); err != nil {
+			return nil, errors.Wrap(err, "parsing event list")
+		}
+
+		events = append(events, page.Items...)
+		if page.NextPageToken == "" {
+			return events, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
 	}
-	req.Header.Add("Content-Type", "application/json")
+}
+
+var ErrNotFound = errors.New("Not found")
 
-	resp, err := c.Do(req)
+func updateCalendarEvent(c *http.Client, calendarId string, ev *GCalEvent) error {
+	data, err := json.Marshal(ev)
 	if err != nil {
-		return errors.Wrap(err, "updating event")
+		return errors.Wrap(err, "marshalling new event")
 	}
 
-	jsonData, _ := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	url := fmt.Sprintf("%v/calendars/%v/events/%v", gcalApiBase, calendarId, ev.Id)
 
-	// If the update failed because the event doesn't exist,
-	// return an error to trigger an insert operation instead
-	if resp.StatusCode == http.StatusNotFound {
+	jsonData, err := gcalDo(c, http.MethodPut, url, data)
+	if apiErr, ok := err.(*GoogleAPIError); ok && apiErr.StatusCode == http.StatusNotFound {
+		// If the update failed because the event doesn't exist,
+		// return an error to trigger an insert operation instead
 		return ErrNotFound
+	} else if err != nil {
+		return errors.Wrap(err, "updating event")
 	}
 
 	newEvent := GCalEvent{}
@@ -171,30 +267,34 @@ func updateCalendarEvent(c *http.Client, calendarId string, ev *GCalEvent) error
 	return nil
 }
 
-func optionallyUpdateCalendar(ev timestampedEventInfo, evCtx EventContext) {
-	if GCalClient == nil {
-		return
-	}
+// gcalSink publishes sessions to a Google Calendar, applying the edit
+// policy to any events which have been edited by hand
+type gcalSink struct {
+	client     *http.Client
+	calendarId string
+	tx         *bolt.Tx
+}
 
-	prodCfg, ok := productsMap[evCtx.Product]
-	if !ok || prodCfg.GCal == "" {
-		log.Print("No calendar configured for", evCtx.Product)
-		return
-	}
+func (gs gcalSink) Target() string {
+	return gcalTargetPrefix + gs.calendarId
+}
 
+func (gs gcalSink) PublishEvent(ev timestampedEventInfo, evCtx EventContext, sequence uint64) error {
 	calEv, err := makeGCalEvent(ev, evCtx)
 	if err != nil {
-		log.Print("Can't convert calendar event:", err)
-		return
+		return errors.Wrap(err, "converting calendar event")
 	}
 
-	err = updateCalendarEvent(GCalClient, prodCfg.GCal, calEv)
-	if err == ErrNotFound {
-		log.Print("Calendar event not found, inserting...")
-		err = insertCalendarEvent(GCalClient, prodCfg.GCal, calEv)
+	if !applyEditPolicy(calEv, getExternalEdit(gs.tx, gs.calendarId, calEv.Id)) {
+		sessionLogger(evCtx.Day, evCtx.Product, ev.SessionId).Info("Calendar event deleted by hand, not updating", "calendar", gs.calendarId, "event", calEv.Id)
+		return nil
 	}
 
-	if err != nil {
-		log.Print("Calendar event update failed:", err)
+	err = updateCalendarEvent(gs.client, gs.calendarId, calEv)
+	if err == ErrNotFound {
+		sessionLogger(evCtx.Day, evCtx.Product, ev.SessionId).Info("Calendar event not found, inserting", "calendar", gs.calendarId, "event", calEv.Id)
+		err = insertCalendarEvent(gs.client, gs.calendarId, calEv)
 	}
+
+	return err
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func newFakeCalendarClient(t *testing.T) (*fakeGoogle, *http.Client) {
+	fg, ga, _ := newFakeServiceAuthenticator(t, 1, false)
+	return fg, &http.Client{Transport: ga}
+}
+
+// fakeCalendarEvent returns the event as the fake holds it
+func fakeCalendarEvent(t *testing.T, fg *fakeGoogle, calendarId, eventId string) GCalEvent {
+	t.Helper()
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	ev := fg.calendars[calendarId][eventId]
+	if ev == nil {
+		t.Fatalf("no event %v in %v", eventId, calendarId)
+	}
+	return ev.GCalEvent
+}
+
+func testSession(spaces int) (timestampedEventInfo, EventContext) {
+	ev := timestampedEventInfo{
+		EventInfo: EventInfo{
+			SessionId:       "12345",
+			ProductName:     "Public Skating",
+			Location:        "Rink 1",
+			StartTime:       "18:00:00",
+			EndTime:         "19:30:00",
+			TotalSpaces:     100,
+			AvailableSpaces: spaces,
+		},
+		UpdatedAt: time.Now(),
+		Product:   "prod-a",
+	}
+	return ev, EventContext{Day: "2026-10-19", Product: "prod-a"}
+}
+
+func TestInsertAndUpdateCalendarEvent(t *testing.T) {
+	fg, c := newFakeCalendarClient(t)
+	const calendarId = "cal@example.com"
+
+	calEv, err := makeGCalEvent(testSession(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertCalendarEvent(c, calendarId, calEv); err != nil {
+		t.Fatalf("inserting event: %v", err)
+	}
+
+	got := fakeCalendarEvent(t, fg, calendarId, calEv.Id)
+	if !gcalEventsMatch(calEv, &got) {
+		t.Errorf("inserted event %+v, want %+v", got, calEv)
+	}
+	if sid, ok := scraperEventSession(&got); !ok || sid != "12345" {
+		t.Errorf("inserted event is for session %q, want 12345", sid)
+	}
+
+	// Inserting it again updates the existing event
+	if err := insertCalendarEvent(c, calendarId, calEv); err != nil {
+		t.Errorf("inserting the event again: %v", err)
+	}
+	if n := len(fg.calendars[calendarId]); n != 1 {
+		t.Errorf("%v events after inserting twice, want 1", n)
+	}
+
+	updated, err := makeGCalEvent(testSession(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated.Summary = "Public Skating (busy)"
+	if err := updateCalendarEvent(c, calendarId, updated); err != nil {
+		t.Fatalf("updating event: %v", err)
+	}
+	got = fakeCalendarEvent(t, fg, calendarId, calEv.Id)
+	if !gcalEventsMatch(updated, &got) {
+		t.Errorf("updated event %+v, want %+v", got, updated)
+	}
+
+	// Events which don't exist can't be updated
+	updated.Id = sessionEventId("67890")
+	if err := updateCalendarEvent(c, calendarId, updated); err != ErrNotFound {
+		t.Errorf("updating a missing event gave %v, want ErrNotFound", err)
+	}
+}
+
+func TestGcalSinkPublishesEvent(t *testing.T) {
+	fg, c := newFakeCalendarClient(t)
+	const calendarId = "cal@example.com"
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The first publish inserts the event, as it's not found to update,
+	// and the second updates it
+	for _, spaces := range []int{40, 10} {
+		ev, evCtx := testSession(spaces)
+		if err := db.View(func(tx *bolt.Tx) error {
+			return gcalSink{c, calendarId, tx}.PublishEvent(ev, evCtx, 0)
+		}); err != nil {
+			t.Fatalf("publishing with %v spaces: %v", spaces, err)
+		}
+
+		want, err := makeGCalEvent(ev, evCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := fakeCalendarEvent(t, fg, calendarId, want.Id)
+		if !gcalEventsMatch(want, &got) {
+			t.Errorf("published event with %v spaces %+v, want %+v", spaces, got, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// CalendarSink is a calendar that session details can be published to.
+// Each product can be mapped to any of the sinks in the products file.
+type CalendarSink interface {
+	// PublishEvent creates or updates the calendar event for a session.
+	// sequence counts the snapshots stored for the session, from 0.
+	PublishEvent(ev timestampedEventInfo, evCtx EventContext, sequence uint64) error
+
+	// Target identifies the calendar, so that failed pushes can be
+	// retried later via sinkForTarget
+	Target() string
+}
+
+const (
+	gcalTargetPrefix   = "gcal:"
+	caldavTargetPrefix = "caldav:"
+)
+
+// sinkForTarget recreates a sink from its Target, or returns nil if that
+// kind of calendar is no longer configured
+func sinkForTarget(tx *bolt.Tx, target string) CalendarSink {
+	switch {
+	case strings.HasPrefix(target, gcalTargetPrefix) && GCalClient != nil:
+		return gcalSink{GCalClient, strings.TrimPrefix(target, gcalTargetPrefix), tx}
+	case strings.HasPrefix(target, caldavTargetPrefix) && CalDAVClient != nil:
+		return newCaldavSink(CalDAVClient, strings.TrimPrefix(target, caldavTargetPrefix), tx)
+	}
+	return nil
+}
+
+// calendarSinks returns the sinks configured for a product.  The
+// transaction is used to look up any state the sinks keep in the database.
+func calendarSinks(tx *bolt.Tx, product ProductId) []CalendarSink {
+	prodCfg := productsMap[product]
+
+	var sinks []CalendarSink
+	if GCalClient != nil && prodCfg.GCal != "" {
+		sinks = append(sinks, gcalSink{GCalClient, prodCfg.GCal, tx})
+	}
+	if CalDAVClient != nil && prodCfg.CalDAV != "" {
+		sinks = append(sinks, newCaldavSink(CalDAVClient, prodCfg.CalDAV, tx))
+	}
+	return sinks
+}
+
+// sinkKind returns the kind of calendar a target is, such as "gcal"
+func sinkKind(target string) string {
+	return strings.SplitN(target, ":", 2)[0]
+}
+
+// optionallyUpdateCalendar publishes the event to the product's calendars.
+// Failures are queued in the outbox within the same transaction, so that
+// they can be retried later by drainOutbox.
+func optionallyUpdateCalendar(tx *bolt.Tx, ev timestampedEventInfo, evCtx EventContext, sequence uint64) {
+	if GCalClient == nil && CalDAVClient == nil {
+		return
+	}
+
+	sinks := calendarSinks(tx, evCtx.Product)
+	if len(sinks) == 0 {
+		slog.Warn("No calendar configured", "day", evCtx.Day, "product", evCtx.Product)
+		return
+	}
+
+	logger := sessionLogger(evCtx.Day, evCtx.Product, ev.SessionId)
+	for _, sink := range sinks {
+		item := outboxItem{
+			Target:       sink.Target(),
+			EventContext: evCtx,
+			Event:        ev,
+			Sequence:     sequence,
+		}
+
+		// Newly found sessions are inserted in batches once the day has
+		// been checked, as there can be a great many at once
+		if gs, ok := sink.(gcalSink); ok && evCtx.newEvents != nil && len(evCtx.History) == 0 {
+			evCtx.newEvents.add(gs.calendarId, item)
+			continue
+		}
+
+		if err := sink.PublishEvent(ev, evCtx, sequence); err != nil {
+			logger.Warn("Calendar event update failed", "target", sink.Target(), "err", err)
+			calendarPushFailures.Inc(sinkKind(sink.Target()))
+			item.LastError = err.Error()
+			if err := enqueueOutbox(tx, item); err != nil {
+				logger.Error("Can't queue calendar event", "target", sink.Target(), "err", err)
+			}
+		} else if err := dequeueOutbox(tx, item); err != nil {
+			// Make sure an older failure isn't retried over this update
+			logger.Error("Can't remove queued calendar event", "target", sink.Target(), "err", err)
+		}
+	}
+}
+
+// gcalInsertBatch collects the Google Calendar events of newly found
+// sessions, for flush to insert together
+type gcalInsertBatch struct {
+	calendarIds []string
+	items       []outboxItem
+}
+
+func (ib *gcalInsertBatch) add(calendarId string, item outboxItem) {
+	ib.calendarIds = append(ib.calendarIds, calendarId)
+	ib.items = append(ib.items, item)
+}
+
+// flush inserts the collected events in batches, queueing any which fail
+// in the outbox as optionallyUpdateCalendar would
+func (ib *gcalInsertBatch) flush(tx *bolt.Tx) {
+	if GCalClient == nil || len(ib.items) == 0 {
+		return
+	}
+
+	var ops []reconcileOp
+	var items []outboxItem
+	for i, item := range ib.items {
+		logger := sessionLogger(item.Day, item.Product, item.Event.SessionId)
+		calEv, err := makeGCalEvent(item.Event, item.EventContext)
+		if err != nil {
+			logger.Warn("Calendar event update failed", "target", item.Target, "err", err)
+			continue
+		}
+		if !applyEditPolicy(calEv, getExternalEdit(tx, ib.calendarIds[i], calEv.Id)) {
+			continue
+		}
+		ops = append(ops, reconcileOp{opInsert, ib.calendarIds[i], item.Day, item.Event.SessionId, calEv, false})
+		items = append(items, item)
+	}
+	ib.calendarIds, ib.items = nil, nil
+
+	for i, err := range applyCalendarOps(GCalClient, ops) {
+		item := items[i]
+		logger := sessionLogger(item.Day, item.Product, item.Event.SessionId)
+		if err != nil {
+			logger.Warn("Calendar event update failed", "target", item.Target, "err", err)
+			calendarPushFailures.Inc(sinkKind(item.Target))
+			item.LastError = err.Error()
+			if err := enqueueOutbox(tx, item); err != nil {
+				logger.Error("Can't queue calendar event", "target", item.Target, "err", err)
+			}
+		} else if err := dequeueOutbox(tx, item); err != nil {
+			logger.Error("Can't remove queued calendar event", "target", item.Target, "err", err)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// The changes log records every snapshot written by updateEvent, in the
+// order they were written, so that a client of the change stream can
+// resume where it left off.  Each record refers to the snapshot by its
+// day, session and the sequence number it was stored under, and the log's
+// own sequence number is the cursor the client resumes from.  Changes are
+// kept for changeRetention, so a client which has been away for longer
+// only gets those which are left.
+
+var changesBucket = []byte("changes")
+
+// changeRecord refers to a snapshot in a session bucket
+type changeRecord struct {
+	Day       string
+	SessionId string
+	Sequence  uint64
+	At        time.Time
+}
+
+// changeRetention is how long changes are kept in the log
+const changeRetention = 30 * 24 * time.Hour
+
+// changeReplayLimit is the most changes replayed from the log at once
+const changeReplayLimit = 1000
+
+func sequenceKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// recordChange adds the change to the log, returning its cursor, and
+// drops changes that have expired
+func recordChange(tx *bolt.Tx, sc SessionChange) (uint64, error) {
+	b, err := tx.CreateBucketIfNotExists(changesBucket)
+	if err != nil {
+		return 0, errors.Wrap(err, "creating changes bucket")
+	}
+
+	now := time.Now()
+	recJson, err := json.Marshal(changeRecord{sc.Day, sc.Current.SessionId, sc.Sequence, now})
+	if err != nil {
+		return 0, errors.Wrap(err, "marshalling change")
+	}
+
+	cursor, err := b.NextSequence()
+	if err != nil {
+		return 0, errors.Wrap(err, "numbering change")
+	}
+	if err := b.Put(sequenceKey(cursor), recJson); err != nil {
+		return 0, errors.Wrap(err, "storing change")
+	}
+
+	// Changes are stored in order, so the expired ones are at the start
+	cutoff := now.Add(-changeRetention)
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		old := changeRecord{}
+		if err := json.Unmarshal(v, &old); err == nil && old.At.After(cutoff) {
+			break
+		}
+		if err := b.Delete(k); err != nil {
+			return 0, errors.Wrap(err, "removing expired change")
+		}
+	}
+
+	return cursor, nil
+}
+
+// changesSince returns the changes logged after the cursor, oldest first,
+// rebuilt from the snapshots they refer to
+func changesSince(tx *bolt.Tx, cursor uint64) ([]SessionChange, error) {
+	b := tx.Bucket(changesBucket)
+	if b == nil {
+		return nil, nil
+	}
+
+	var changes []SessionChange
+	c := b.Cursor()
+	for k, v := c.Seek(sequenceKey(cursor + 1)); k != nil && len(changes) < changeReplayLimit; k, v = c.Next() {
+		rec := changeRecord{}
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return nil, errors.Wrapf(err, "parsing change %x", k)
+		}
+
+		sc, err := loadChange(tx, rec)
+		if err == ErrNoSuchEvent {
+			// The snapshot has gone, so there's nothing to replay
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sc.Cursor = binary.BigEndian.Uint64(k)
+		changes = append(changes, sc)
+	}
+
+	return changes, nil
+}
+
+// latestCursor returns the cursor of the most recent change
+func latestCursor(tx *bolt.Tx) uint64 {
+	if b := tx.Bucket(changesBucket); b != nil {
+		return b.Sequence()
+	}
+	return 0
+}
+
+// loadChange rebuilds a change from the snapshot and the one before it
+func loadChange(tx *bolt.Tx, rec changeRecord) (SessionChange, error) {
+	day := tx.Bucket([]byte(rec.Day))
+	if day == nil {
+		return SessionChange{}, ErrNoSuchEvent
+	}
+	evs := day.Bucket([]byte("events"))
+	if evs == nil {
+		return SessionChange{}, ErrNoSuchEvent
+	}
+	sb := evs.Bucket([]byte(rec.SessionId))
+	if sb == nil {
+		return SessionChange{}, ErrNoSuchEvent
+	}
+
+	evJson := sb.Get(sequenceKey(rec.Sequence))
+	if evJson == nil {
+		return SessionChange{}, ErrNoSuchEvent
+	}
+	sc := SessionChange{Sequence: rec.Sequence}
+	if err := json.Unmarshal(evJson, &sc.Current); err != nil {
+		return SessionChange{}, errors.Wrapf(err, "parsing session %v", rec.SessionId)
+	}
+
+	if prevJson := sb.Get(sequenceKey(rec.Sequence - 1)); prevJson != nil {
+		sc.Previous = &timestampedEventInfo{}
+		if err := json.Unmarshal(prevJson, sc.Previous); err != nil {
+			return SessionChange{}, errors.Wrapf(err, "parsing session %v", rec.SessionId)
+		}
+	}
+
+	productsAvailable := []ProductId{}
+	json.Unmarshal(day.Get([]byte("products")), &productsAvailable)
+	sc.EventContext = EventContext{Day: rec.Day, Product: sessionProduct(productsAvailable, sc.Current)}
+
+	return sc, nil
+}
+
+// changeBroadcaster is a notifier which passes every session change on
+// to the open change streams
+type changeBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[*changeSubscriber]bool
+}
+
+// changeSubscriber receives changes for one stream.  If it falls behind,
+// changes are dropped and lagged is signalled, so that the stream can
+// catch up from the log instead.
+type changeSubscriber struct {
+	changes chan SessionChange
+	lagged  chan struct{}
+}
+
+func newChangeBroadcaster() *changeBroadcaster {
+	return &changeBroadcaster{subscribers: map[*changeSubscriber]bool{}}
+}
+
+// NotifyChange never blocks, so that a slow client can't hold up the checks
+func (cb *changeBroadcaster) NotifyChange(sc SessionChange) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	for sub := range cb.subscribers {
+		select {
+		case sub.changes <- sc:
+		default:
+			select {
+			case sub.lagged <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (cb *changeBroadcaster) NotifyDigest(days []DaySummary) error {
+	return nil
+}
+
+func (cb *changeBroadcaster) subscribe() *changeSubscriber {
+	sub := &changeSubscriber{make(chan SessionChange, 64), make(chan struct{}, 1)}
+	cb.mu.Lock()
+	cb.subscribers[sub] = true
+	cb.mu.Unlock()
+	return sub
+}
+
+func (cb *changeBroadcaster) unsubscribe(sub *changeSubscriber) {
+	cb.mu.Lock()
+	delete(cb.subscribers, sub)
+	cb.mu.Unlock()
+}
+
+// sseKeepalive is how often a comment is sent on an idle change stream,
+// so that proxies don't close it
+const sseKeepalive = 30 * time.Second
+
+// changesHandler streams session changes as server-sent events, each with
+// its cursor as the event id.  See:
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+//
+// A client resumes by giving the cursor of the last change it saw, in the
+// cursor parameter or the Last-Event-ID header sent by browsers when they
+// reconnect, and the changes since are replayed from the log.  Otherwise
+// only new changes are sent.
+func changesHandler(db *bolt.DB, cb *changeBroadcaster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		resumeFrom := r.Header.Get("Last-Event-ID")
+		if c := r.URL.Query().Get("cursor"); c != "" {
+			resumeFrom = c
+		}
+
+		var cursor uint64
+		if resumeFrom != "" {
+			var err error
+			if cursor, err = strconv.ParseUint(resumeFrom, 10, 64); err != nil {
+				http.Error(w, "bad cursor", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Subscribe before looking at the log, so that nothing is missed
+		sub := cb.subscribe()
+		defer cb.unsubscribe(sub)
+
+		if resumeFrom == "" {
+			db.View(func(tx *bolt.Tx) error {
+				cursor = latestCursor(tx)
+				return nil
+			})
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		send := func(sc SessionChange) {
+			// Changes may be both replayed and broadcast
+			if sc.Cursor <= cursor {
+				return
+			}
+			data, err := json.Marshal(sc)
+			if err != nil {
+				slog.Error("Can't marshal session change", "err", err)
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", sc.Cursor, data)
+			cursor = sc.Cursor
+		}
+
+		catchUp := func() error {
+			for {
+				var changes []SessionChange
+				if err := db.View(func(tx *bolt.Tx) error {
+					var err error
+					changes, err = changesSince(tx, cursor)
+					return err
+				}); err != nil {
+					return err
+				}
+
+				for _, sc := range changes {
+					send(sc)
+				}
+				flusher.Flush()
+
+				if len(changes) < changeReplayLimit {
+					return nil
+				}
+			}
+		}
+
+		if err := catchUp(); err != nil {
+			slog.Error("Can't replay changes", "cursor", cursor, "err", err)
+			return
+		}
+
+		keepalive := time.NewTicker(sseKeepalive)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+
+			case sc := <-sub.changes:
+				send(sc)
+
+			case <-sub.lagged:
+				if err := catchUp(); err != nil {
+					slog.Error("Can't replay changes", "cursor", cursor, "err", err)
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
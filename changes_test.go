@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// recordTestChanges stores the snapshots of session 12345, logging each
+func recordTestChanges(t *testing.T, db *bolt.DB, snapshots ...timestampedEventInfo) {
+	t.Helper()
+	_, evCtx := testSession(0)
+	for _, ev := range snapshots {
+		putTestSnapshots(t, db, evCtx.Day, evCtx.Product, ev)
+		if err := db.Update(func(tx *bolt.Tx) error {
+			seq := tx.Bucket([]byte(evCtx.Day)).Bucket([]byte("events")).Bucket([]byte(ev.SessionId)).Sequence()
+			_, err := recordChange(tx, SessionChange{EventContext: evCtx, Current: ev, Sequence: seq})
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChangesRetention(t *testing.T) {
+	db := openTestDb(t)
+
+	// Changes logged a while ago, the first before they were timestamped
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(changesBucket)
+		if err != nil {
+			return err
+		}
+		for _, at := range []time.Time{{}, time.Now().Add(-changeRetention - time.Hour), time.Now().Add(-changeRetention + time.Hour)} {
+			seq, _ := b.NextSequence()
+			recJson, _ := json.Marshal(changeRecord{Day: "2026-10-19", SessionId: "12345", Sequence: 1, At: at})
+			if err := b.Put(sequenceKey(seq), recJson); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ev, _ := testSession(40)
+	recordTestChanges(t, db, ev)
+
+	var cursors []uint64
+	if err := db.View(func(tx *bolt.Tx) error {
+		changes, err := changesSince(tx, 0)
+		for _, sc := range changes {
+			cursors = append(cursors, sc.Cursor)
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The cursors carry on, so clients can still resume
+	if len(cursors) != 2 || cursors[0] != 3 || cursors[1] != 4 {
+		t.Errorf("changes kept %v, want 3 and 4", cursors)
+	}
+}
+
+// readChangeIds reads events from the stream until n have arrived,
+// returning their ids
+func readChangeIds(t *testing.T, r *bufio.Reader, n int) []string {
+	t.Helper()
+	var ids []string
+	for len(ids) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v, after %v", err, ids)
+		}
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+		}
+	}
+	return ids
+}
+
+func TestChangesStreamResumes(t *testing.T) {
+	db := openTestDb(t)
+	first, _ := testSession(50)
+	second, _ := testSession(40)
+	third, _ := testSession(30)
+	recordTestChanges(t, db, first, second, third)
+
+	cb := newChangeBroadcaster()
+	srv := httptest.NewServer(changesHandler(db, cb))
+	t.Cleanup(srv.Close)
+
+	stream := func(lastEventId string) *bufio.Reader {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("stream gave %v", resp.Status)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+
+	// A reconnecting browser gets the changes it missed, then new ones
+	resumed := stream("1")
+	if ids := readChangeIds(t, resumed, 2); strings.Join(ids, ",") != "2,3" {
+		t.Errorf("resumed with %v, want 2,3", ids)
+	}
+	// A new client only gets new changes
+	fresh := stream("")
+
+	fourth, _ := testSession(20)
+	recordTestChanges(t, db, fourth)
+	if err := db.View(func(tx *bolt.Tx) error {
+		changes, err := changesSince(tx, 3)
+		if err == nil {
+			cb.NotifyChange(changes[0])
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := readChangeIds(t, resumed, 1); ids[0] != "4" {
+		t.Errorf("resumed stream then got %v, want 4", ids)
+	}
+	if ids := readChangeIds(t, fresh, 1); ids[0] != "4" {
+		t.Errorf("new stream got %v, want 4", ids)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Last-Event-ID", "yesterday")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad Last-Event-ID gave %v %v", resp.Status, err)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"net/http"
+	"time"
+)
+
+// The dashboard is a single page showing the coming days, built from the
+// JSON API.  It refreshes itself when told of changes by the event stream,
+// which is fed by a notifier registered when serving.
+
+//go:embed dashboard.html
+var dashboardHtml []byte
+
+// dashboardStart is used as the modification time of the dashboard, as
+// it can only change when the binary does
+var dashboardStart = time.Now()
+
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, "dashboard.html", dashboardStart, bytes.NewReader(dashboardHtml))
+}
@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/boltdb/bolt"
 )
@@ -17,6 +17,23 @@ import (
 // /2019-03-27/events/
 // /2019-03-27/events/session-id/
 // /2019-03-27/events/session-id/<nextsequence>:json(eventInfo)
+// /2019-03-27/raw/session-id/<sequence>:gzip(json) - as sent, for each snapshot
+// /2019-03-27/raw/session-id/<sequence><unix-nanoseconds>:gzip(json) - as sent, when only fields we ignore changed
+
+// Other buckets sit alongside the days, so anything iterating over
+// days should check isDayKey:
+// /outbox/<sink-target>|<session-id>:json(outboxItem)
+// /caldav-etags/<resource-url>:etag
+// /caldav-conflicts/<resource-url>:time-detected
+// /gcal-sync/<calendar-id>/token:sync-token
+// /gcal-sync/<calendar-id>/edits/<event-id>:json(externalEdit)
+// /gcal-sync/<calendar-id>/days/<event-id>:day
+// /changes/<nextsequence>:json(changeRecord)
+// /runs/<nextsequence>:json(runRecord)
+// /last-success/<command>:json(runRecord)
+// /metrics/<command>/<metric-name>:json([]savedSeries) - counters kept between runs from cron
+// /schema/<endpoint>/state:json(schemaState)
+// /schema/<endpoint>/samples/<nextsequence>:json(schemaSample)
 
 func dumpDb(db *bolt.DB) {
 	if err := db.View(func(tx *bolt.Tx) error {
@@ -35,7 +52,7 @@ func dumpDb(db *bolt.DB) {
 
 		return nil
 	}); err != nil {
-		log.Println("Can't dump db:", err)
+		slog.Error("Can't dump db", "err", err)
 	}
 }
 
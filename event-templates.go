@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// EventTemplates are text/template templates for the content of a
+// product's calendar events.  Each is executed with an eventTemplateData,
+// and any left empty keeps the default content, e.g. a Summary of
+// "{{.ProductName}} ({{.AvailableSpaces}} free)"
+type EventTemplates struct {
+	Summary     string
+	Description string
+	Location    string
+
+	summary, description, location *template.Template
+}
+
+func (et *EventTemplates) compile() error {
+	for _, t := range []struct {
+		name string
+		text string
+		tmpl **template.Template
+	}{
+		{"summary", et.Summary, &et.summary},
+		{"description", et.Description, &et.description},
+		{"location", et.Location, &et.location},
+	} {
+		if t.text == "" {
+			continue
+		}
+
+		var err error
+		if *t.tmpl, err = template.New(t.name).Option("missingkey=error").Parse(t.text); err != nil {
+			return errors.Wrapf(err, "parsing %v template", t.name)
+		}
+	}
+	return nil
+}
+
+// eventTemplateData is what the templates have access to: all the session
+// details, the computed bookings and the session's earlier snapshots
+type eventTemplateData struct {
+	timestampedEventInfo
+	Day string
+
+	// Booked counts every booking, Academy and other, and CapacityPercent
+	// is how much of Capacity that is.  The Academy's free spaces are
+	// held separately from the TotalSpaces on sale, so Capacity is both.
+	Academy         int
+	Other           int
+	Booked          int
+	Capacity        int
+	CapacityPercent int
+	BookingLink     string
+
+	// History holds the session's earlier snapshots, oldest first
+	History []timestampedEventInfo
+}
+
+func newEventTemplateData(ev timestampedEventInfo, evCtx EventContext) eventTemplateData {
+	s := summariseEvent(ev.EventInfo)
+
+	data := eventTemplateData{
+		timestampedEventInfo: ev,
+		Day:                  evCtx.Day,
+		Academy:              s.Academy,
+		Other:                s.Other,
+		Booked:               s.Academy + s.Other,
+		Capacity:             ev.TotalSpaces + ev.CapacityFreeAcademy,
+		BookingLink:          makeProductLink(evCtx.Product),
+		History:              evCtx.History,
+	}
+	if data.Capacity > 0 {
+		data.CapacityPercent = 100 * data.Booked / data.Capacity
+	}
+
+	return data
+}
+
+// apply executes any templates which are set, replacing the corresponding
+// content of the event
+func (et *EventTemplates) apply(calEv *GCalEvent, data eventTemplateData) error {
+	for _, t := range []struct {
+		tmpl *template.Template
+		dest *string
+	}{
+		{et.summary, &calEv.Summary},
+		{et.description, &calEv.Description},
+		{et.location, &calEv.Location},
+	} {
+		if t.tmpl == nil {
+			continue
+		}
+
+		buf := &bytes.Buffer{}
+		if err := t.tmpl.Execute(buf, data); err != nil {
+			return errors.Wrapf(err, "executing %v template", t.tmpl.Name())
+		}
+		*t.dest = buf.String()
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEventTemplateDataBookings(t *testing.T) {
+	ev, evCtx := testSession(60)
+	ev.CapacityFreeAcademy = 20
+	ev.AvailableFreeSpaces = 10
+
+	data := newEventTemplateData(ev, evCtx)
+	if data.Academy != 10 || data.Other != 40 || data.Booked != 50 {
+		t.Errorf("bookings %v Academy, %v other, %v in all, want 10, 40 and 50", data.Academy, data.Other, data.Booked)
+	}
+	if data.Capacity != 120 || data.CapacityPercent != 41 {
+		t.Errorf("%v%% of %v booked, want 41%% of 120", data.CapacityPercent, data.Capacity)
+	}
+
+	ev.TotalSpaces, ev.AvailableSpaces, ev.CapacityFreeAcademy, ev.AvailableFreeSpaces = 0, 0, 0, 0
+	if data := newEventTemplateData(ev, evCtx); data.CapacityPercent != 0 {
+		t.Errorf("%v%% of no capacity booked", data.CapacityPercent)
+	}
+}
+
+func TestMakeGCalEventProductConfig(t *testing.T) {
+	templates := EventTemplates{
+		Summary:     "{{.ProductName}}: {{.Booked}} of {{.Capacity}}",
+		Description: "{{.CapacityPercent}}% full, {{len .History}} earlier\n{{.BookingLink}}",
+	}
+	if err := templates.compile(); err != nil {
+		t.Fatal(err)
+	}
+	reminders := []GCalReminder{{"popup", 30}}
+	useProducts(t, map[ProductId]ProductConfig{
+		"prod-a": {Templates: templates, ColorId: "5", Reminders: reminders},
+		"prod-b": {},
+	})
+
+	ev, evCtx := testSession(60)
+	evCtx.History = []timestampedEventInfo{ev}
+	calEv, err := makeGCalEvent(ev, evCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calEv.Summary != "Public Skating: 40 of 100" ||
+		calEv.Description != "40% full, 1 earlier\n"+makeProductLink("prod-a") {
+		t.Errorf("templated event %q, %q", calEv.Summary, calEv.Description)
+	}
+	// Templates left empty keep the default content
+	if calEv.Location != "Rink 1" {
+		t.Errorf("location %q, want the default", calEv.Location)
+	}
+	if calEv.ColorId != "5" || calEv.Reminders == nil || calEv.Reminders.UseDefault ||
+		!reflect.DeepEqual(calEv.Reminders.Overrides, reminders) {
+		t.Errorf("colour %q and reminders %+v", calEv.ColorId, calEv.Reminders)
+	}
+
+	// Products without any configuration get the defaults
+	evCtx.Product = "prod-b"
+	calEv, err = makeGCalEvent(ev, evCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calEv.Summary != "Public Skating" || !strings.HasPrefix(calEv.Description, "0 Academy, 40 other booked\n") ||
+		calEv.ColorId != "" || calEv.Reminders != nil {
+		t.Errorf("default event %+v", calEv)
+	}
+
+	// Templates which can't be executed fail the event, rather than
+	// pushing something half done
+	bad := EventTemplates{Summary: "{{.Nonsense}}"}
+	if err := bad.compile(); err != nil {
+		t.Fatal(err)
+	}
+	useProducts(t, map[ProductId]ProductConfig{"prod-a": {Templates: bad}})
+	evCtx.Product = "prod-a"
+	if _, err := makeGCalEvent(ev, evCtx); err == nil {
+		t.Errorf("template using an unknown field succeeded")
+	}
+}
@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeGoogle stands in for Google's OAuth and Calendar APIs, so that the
+// token and calendar code can be exercised end to end without a network
+// or a real calendar.  Everything is held in memory, and only the parts
+// of the APIs which we use are implemented.
+
+const (
+	fakeClientId     = "fake-client.apps.googleusercontent.com"
+	fakeClientSecret = "fake-client-secret"
+	fakeClientEmail  = "ice-scraper@fake-project.iam.gserviceaccount.com"
+
+	// fakeTokenLifetime is how long access tokens last, as with Google
+	fakeTokenLifetime = time.Hour
+)
+
+type fakeGoogle struct {
+	root string
+
+	mu sync.Mutex
+	// failures are returned to the next Calendar API requests, in turn
+	failures []fakeFailure
+	// The service account's keys, by key id
+	keys map[string]*rsa.PrivateKey
+	// Tokens and authorisation codes, mapped to what they allow
+	accessTokens  map[string]fakeToken
+	refreshTokens map[string]string
+	codes         map[string]fakeCode
+	// Events by calendar and event id.  seq counts changes, and is used
+	// for sync tokens.
+	calendars map[string]map[string]*fakeEvent
+	seq       int
+	// pageSize limits the events listed at once, however many are asked
+	// for, as Google does
+	pageSize int
+}
+
+// fakeFailure is an error response, such as Google gives when rate
+// limiting or when its servers are having trouble
+type fakeFailure struct {
+	Status     int
+	RetryAfter string
+}
+
+type fakeToken struct {
+	Scope  string
+	Expiry time.Time
+}
+
+type fakeCode struct {
+	Scope       string
+	RedirectUri string
+	Challenge   string
+}
+
+type fakeEvent struct {
+	GCalEvent
+	// Changed is the value of seq when the event last changed
+	Changed int
+}
+
+// newFakeGoogle serves a fake for the duration of the test, with a key
+// for the service account in each of the credentials files returned
+func newFakeGoogle(t *testing.T, numKeys int, pkcs1 bool) (*fakeGoogle, []string) {
+	fg := &fakeGoogle{
+		keys:          map[string]*rsa.PrivateKey{},
+		accessTokens:  map[string]fakeToken{},
+		refreshTokens: map[string]string{},
+		codes:         map[string]fakeCode{},
+		calendars:     map[string]map[string]*fakeEvent{},
+	}
+	srv := httptest.NewServer(fg)
+	t.Cleanup(srv.Close)
+	fg.root = srv.URL
+
+	dir := t.TempDir()
+	var credFiles []string
+	for i := 1; i <= numKeys; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("creds-%d.json", i))
+		if err := fg.writeServiceCredentials(file, fmt.Sprintf("fake-key-%d", i), pkcs1); err != nil {
+			t.Fatal(err)
+		}
+		credFiles = append(credFiles, file)
+	}
+	return fg, credFiles
+}
+
+// useFakeCalendar sends Calendar API requests to the fake until the end
+// of the test
+func useFakeCalendar(t *testing.T, fg *fakeGoogle) {
+	base, batchUrl := gcalApiBase, gcalBatchUrl
+	t.Cleanup(func() { gcalApiBase, gcalBatchUrl = base, batchUrl })
+	setGcalApiRoot(fg.root)
+}
+
+// writeServiceCredentials generates a new key for the service account,
+// and writes a credentials file for it pointing at the fake
+func (fg *fakeGoogle) writeServiceCredentials(credFile, keyId string, pkcs1 bool) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return errors.Wrap(err, "generating key")
+	}
+	fg.keys[keyId] = key
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if !pkcs1 {
+		keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return errors.Wrap(err, "marshalling key")
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}
+	}
+
+	return writeJsonFile(credFile, map[string]interface{}{
+		"type":           "service_account",
+		"project_id":     "fake-project",
+		"private_key_id": keyId,
+		"private_key":    string(pem.EncodeToMemory(block)),
+		"client_email":   fakeClientEmail,
+		"client_id":      "1",
+		"auth_uri":       fg.root + "/auth",
+		"token_uri":      fg.root + "/token",
+	})
+}
+
+// writeUserCredentials writes an installed app credentials file pointing
+// at the fake, if one is wanted
+func (fg *fakeGoogle) writeUserCredentials(userCredFile string) error {
+	if userCredFile == "" {
+		return nil
+	}
+
+	return writeJsonFile(userCredFile, map[string]interface{}{
+		"installed": map[string]string{
+			"client_id":     fakeClientId,
+			"client_secret": fakeClientSecret,
+			"auth_uri":      fg.root + "/auth",
+			"token_uri":     fg.root + "/token",
+		},
+	})
+}
+
+func writeJsonFile(file string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "marshalling %v", file)
+	}
+	return errors.Wrapf(ioutil.WriteFile(file, data, 0600), "writing %v", file)
+}
+
+func (fg *fakeGoogle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/auth":
+		fg.handleAuth(w, r)
+	case r.URL.Path == "/token":
+		fg.handleToken(w, r)
+	case r.URL.Path == "/revoke":
+		fg.handleRevoke(w, r)
+	case r.URL.Path == "/batch"+gcalBatchPath:
+		fg.handleBatch(w, r)
+	case strings.HasPrefix(r.URL.Path, gcalBatchPath+"/calendars/"):
+		fg.handleCalendar(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fakeNewToken returns a random token of the given kind
+func fakeNewToken(kind string) string {
+	s, err := randomUrlString(12)
+	if err != nil {
+		panic(err)
+	}
+	return "fake-" + kind + "-" + s
+}
+
+// handleAuth gives consent straight away, redirecting back with a code
+func (fg *fakeGoogle) handleAuth(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != fakeClientId {
+		http.Error(w, "Unknown client", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "Bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := fakeNewToken("code")
+	fg.mu.Lock()
+	fg.codes[code] = fakeCode{q.Get("scope"), q.Get("redirect_uri"), q.Get("code_challenge")}
+	fg.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// handleToken grants access tokens for signed assertions, refresh tokens
+// and authorisation codes, as Google's token endpoint does
+func (fg *fakeGoogle) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		fakeTokenError(w, "invalid_request", err.Error())
+		return
+	}
+	form := r.PostForm
+
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	var scope, refreshToken string
+	switch form.Get("grant_type") {
+	case TokenGrantType:
+		var err error
+		if scope, err = fg.checkAssertion(form.Get("assertion")); err != nil {
+			fakeTokenError(w, "invalid_grant", err.Error())
+			return
+		}
+
+	case "refresh_token":
+		if form.Get("client_id") != fakeClientId || form.Get("client_secret") != fakeClientSecret {
+			fakeTokenError(w, "invalid_client", "Unknown client")
+			return
+		}
+		var ok bool
+		if scope, ok = fg.refreshTokens[form.Get("refresh_token")]; !ok {
+			fakeTokenError(w, "invalid_grant", "Token has been expired or revoked.")
+			return
+		}
+
+	case "authorization_code":
+		if form.Get("client_id") != fakeClientId || form.Get("client_secret") != fakeClientSecret {
+			fakeTokenError(w, "invalid_client", "Unknown client")
+			return
+		}
+		code, ok := fg.codes[form.Get("code")]
+		if !ok {
+			fakeTokenError(w, "invalid_grant", "Malformed auth code.")
+			return
+		}
+		delete(fg.codes, form.Get("code"))
+
+		challenge := sha256.Sum256([]byte(form.Get("code_verifier")))
+		if code.Challenge != "" && code.Challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			fakeTokenError(w, "invalid_grant", "Invalid code verifier.")
+			return
+		}
+		if code.RedirectUri != form.Get("redirect_uri") {
+			fakeTokenError(w, "redirect_uri_mismatch", "Bad Request")
+			return
+		}
+
+		scope = code.Scope
+		refreshToken = fakeNewToken("refresh")
+		fg.refreshTokens[refreshToken] = scope
+
+	default:
+		fakeTokenError(w, "unsupported_grant_type", "Invalid grant_type: "+form.Get("grant_type"))
+		return
+	}
+
+	accessToken := fakeNewToken("access")
+	fg.accessTokens[accessToken] = fakeToken{scope, time.Now().Add(fakeTokenLifetime)}
+
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"access_token":  accessToken,
+		"expires_in":    int64(fakeTokenLifetime / time.Second),
+		"token_type":    "Bearer",
+		"scope":         scope,
+		"refresh_token": refreshToken,
+	})
+}
+
+// checkAssertion verifies a service account's signed JWT, returning the
+// scopes it asks for
+func (fg *fakeGoogle) checkAssertion(assertion string) (string, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed assertion")
+	}
+
+	var header struct {
+		Alg string
+		Typ string
+		Kid string
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "RS256" {
+		return "", errors.Errorf("unexpected algorithm %v", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "decoding signature")
+	}
+	d := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	// Without a key id, Google tries each of the account's keys
+	verified := false
+	for id, key := range fg.keys {
+		if header.Kid != "" && header.Kid != id {
+			continue
+		}
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, d[:], sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", errors.New("Invalid JWT Signature.")
+	}
+
+	var claims struct {
+		Aud   string
+		Iss   string
+		Scope string
+		Exp   int64
+		Iat   int64
+	}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+	switch {
+	case claims.Iss != fakeClientEmail:
+		return "", errors.Errorf("unknown issuer %v", claims.Iss)
+	case claims.Aud != fg.root+"/token":
+		return "", errors.Errorf("unexpected audience %v", claims.Aud)
+	case claims.Scope == "":
+		return "", errors.New("no scope requested")
+	case claims.Exp < now || claims.Iat > now+60 || claims.Exp-claims.Iat > 3600:
+		return "", errors.New("invalid JWT: token must be a short-lived token and in a reasonable timeframe")
+	}
+
+	return claims.Scope, nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.Wrap(err, "decoding JWT")
+	}
+	return errors.Wrap(json.Unmarshal(data, v), "parsing JWT")
+}
+
+// handleRevoke revokes an access or refresh token
+func (fg *fakeGoogle) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	_, access := fg.accessTokens[token]
+	_, refresh := fg.refreshTokens[token]
+	if !access && !refresh {
+		fakeTokenError(w, "invalid_token", "Token expired or revoked")
+		return
+	}
+
+	delete(fg.accessTokens, token)
+	delete(fg.refreshTokens, token)
+	writeJson(w, http.StatusOK, map[string]interface{}{})
+}
+
+func fakeTokenError(w http.ResponseWriter, code, description string) {
+	writeJson(w, http.StatusBadRequest, map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// fakeApiError writes an error in Google's usual envelope
+func fakeApiError(w http.ResponseWriter, status int, reason, message string) {
+	writeJson(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"errors": []map[string]string{
+				{"domain": "global", "reason": reason, "message": message},
+			},
+		},
+	})
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("fake Google can't write response", "err", err)
+	}
+}
+
+// fakeScopeAllows reports whether a token with the given scopes may make
+// a request, with the read only scopes not allowing changes
+func fakeScopeAllows(scopes string, write bool) bool {
+	for _, s := range strings.Fields(scopes) {
+		switch s {
+		case "https://www.googleapis.com/auth/calendar",
+			"https://www.googleapis.com/auth/calendar.events":
+			return true
+		case "https://www.googleapis.com/auth/calendar.readonly",
+			"https://www.googleapis.com/auth/calendar.events.readonly":
+			if !write {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bearerToken returns the request's access token, if it's valid.  It must
+// be called with the mutex held.
+func (fg *fakeGoogle) bearerToken(r *http.Request) (fakeToken, bool) {
+	token, ok := fg.accessTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	if !ok || token.Expiry.Before(time.Now()) {
+		return fakeToken{}, false
+	}
+	return token, true
+}
+
+// authorise checks the request's access token, writing an error if it
+// isn't allowed.  It must be called with the mutex held.
+func (fg *fakeGoogle) authorise(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := fg.bearerToken(r)
+	if !ok {
+		fakeApiError(w, http.StatusUnauthorized, "authError", "Invalid Credentials")
+		return false
+	}
+
+	write := r.Method != http.MethodGet
+	if !fakeScopeAllows(token.Scope, write) {
+		fakeApiError(w, http.StatusForbidden, "insufficientPermissions", "Request had insufficient authentication scopes.")
+		return false
+	}
+	return true
+}
+
+// handleCalendar implements the events resource:
+// https://developers.google.com/calendar/v3/reference/events
+func (fg *fakeGoogle) handleCalendar(w http.ResponseWriter, r *http.Request) {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+
+	if !fg.authorise(w, r) {
+		return
+	}
+
+	if len(fg.failures) > 0 {
+		f := fg.failures[0]
+		fg.failures = fg.failures[1:]
+		if f.RetryAfter != "" {
+			w.Header().Set("Retry-After", f.RetryAfter)
+		}
+		if f.Status == http.StatusTooManyRequests {
+			fakeApiError(w, f.Status, "rateLimitExceeded", "Rate Limit Exceeded")
+		} else {
+			fakeApiError(w, f.Status, "backendError", "Backend Error")
+		}
+		return
+	}
+
+	// The path is /calendar/v3/calendars/<calendar>/events[/<event>]
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, gcalBatchPath+"/calendars/"), "/")
+	if len(path) < 2 || len(path) > 3 || path[1] != "events" {
+		fakeApiError(w, http.StatusNotFound, "notFound", "Not Found")
+		return
+	}
+
+	calendarId := path[0]
+	events := fg.calendars[calendarId]
+	if events == nil {
+		events = map[string]*fakeEvent{}
+		fg.calendars[calendarId] = events
+	}
+
+	if len(path) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			fg.listEvents(w, r, events)
+		case http.MethodPost:
+			fg.insertEvent(w, r, events)
+		default:
+			fakeApiError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method Not Allowed")
+		}
+		return
+	}
+
+	ev := events[path[2]]
+	if ev == nil {
+		fakeApiError(w, http.StatusNotFound, "notFound", "Not Found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, ev.GCalEvent)
+
+	case http.MethodPut:
+		update, ok := readFakeEvent(w, r)
+		if !ok {
+			return
+		}
+		update.Id = ev.Id
+		fg.seq++
+		ev.GCalEvent, ev.Changed = update, fg.seq
+		writeJson(w, http.StatusOK, ev.GCalEvent)
+
+	case http.MethodDelete:
+		if ev.Status == "cancelled" {
+			fakeApiError(w, http.StatusGone, "deleted", "Resource has been deleted")
+			return
+		}
+		fg.seq++
+		ev.Status, ev.Changed = "cancelled", fg.seq
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeApiError(w, http.StatusMethodNotAllowed, "methodNotAllowed", "Method Not Allowed")
+	}
+}
+
+func (fg *fakeGoogle) insertEvent(w http.ResponseWriter, r *http.Request, events map[string]*fakeEvent) {
+	ev, ok := readFakeEvent(w, r)
+	if !ok {
+		return
+	}
+
+	if ev.Id == "" {
+		ev.Id = sessionEventId(fakeNewToken("event"))
+	}
+	// Deleted events keep their id, as with Google
+	if events[ev.Id] != nil {
+		fakeApiError(w, http.StatusConflict, "duplicate", "The requested identifier already exists.")
+		return
+	}
+
+	fg.seq++
+	events[ev.Id] = &fakeEvent{ev, fg.seq}
+	writeJson(w, http.StatusOK, ev)
+}
+
+func readFakeEvent(w http.ResponseWriter, r *http.Request) (GCalEvent, bool) {
+	ev := GCalEvent{}
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+		fakeApiError(w, http.StatusBadRequest, "parseError", "Parse Error")
+		return ev, false
+	}
+	if ev.Start.DateTime.IsZero() || ev.End.DateTime.IsZero() {
+		fakeApiError(w, http.StatusBadRequest, "required", "Missing time zone definition for start time.")
+		return ev, false
+	}
+	if ev.Status == "" {
+		ev.Status = "confirmed"
+	}
+	return ev, true
+}
+
+// listEvents returns the matching events in pages, with a sync token for
+// the next incremental list on the last
+func (fg *fakeGoogle) listEvents(w http.ResponseWriter, r *http.Request, events map[string]*fakeEvent) {
+	q := r.URL.Query()
+
+	since := -1
+	if token := q.Get("syncToken"); token != "" {
+		var err error
+		if since, err = strconv.Atoi(token); err != nil || since > fg.seq {
+			fakeApiError(w, http.StatusGone, "fullSyncRequired", "Sync token is no longer valid, a full sync is required.")
+			return
+		}
+	}
+
+	var timeMin, timeMax time.Time
+	if t := q.Get("timeMin"); t != "" {
+		timeMin, _ = time.Parse(time.RFC3339, t)
+	}
+	if t := q.Get("timeMax"); t != "" {
+		timeMax, _ = time.Parse(time.RFC3339, t)
+	}
+
+	items := []GCalEvent{}
+	for _, ev := range events {
+		switch {
+		case since >= 0 && ev.Changed <= since:
+			continue
+		case since < 0 && ev.Status == "cancelled" && q.Get("showDeleted") != "true":
+			continue
+		case !timeMin.IsZero() && !ev.End.DateTime.After(timeMin):
+			continue
+		case !timeMax.IsZero() && !ev.Start.DateTime.Before(timeMax):
+			continue
+		}
+		items = append(items, ev.GCalEvent)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Id < items[j].Id })
+
+	// Page tokens are the offset of the page in the list
+	offset, _ := strconv.Atoi(q.Get("pageToken"))
+	if offset > len(items) {
+		offset = len(items)
+	}
+	items = items[offset:]
+	size := len(items)
+	if max, err := strconv.Atoi(q.Get("maxResults")); err == nil && max < size {
+		size = max
+	}
+	if fg.pageSize > 0 && fg.pageSize < size {
+		size = fg.pageSize
+	}
+
+	page := map[string]interface{}{
+		"kind":  "calendar#events",
+		"items": items[:size],
+	}
+	if size < len(items) {
+		page["nextPageToken"] = strconv.Itoa(offset + size)
+	} else {
+		page["nextSyncToken"] = strconv.Itoa(fg.seq)
+	}
+	writeJson(w, http.StatusOK, page)
+}
+
+// handleBatch splits a batch into its requests, handling each as if it
+// had been made directly, and returns the responses in a batch
+func (fg *fakeGoogle) handleBatch(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		fakeApiError(w, http.StatusBadRequest, "badContent", "Batch must be multipart/mixed")
+		return
+	}
+
+	// Each request in the batch is authorised separately too
+	fg.mu.Lock()
+	_, ok := fg.bearerToken(r)
+	fg.mu.Unlock()
+	if !ok {
+		fakeApiError(w, http.StatusUnauthorized, "authError", "Invalid Credentials")
+		return
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			fakeApiError(w, http.StatusBadRequest, "badContent", "Can't parse batch part")
+			return
+		}
+		reqBody, _ := ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+		req.Header.Set("Authorization", r.Header.Get("Authorization"))
+
+		resp := &fakeResponse{header: http.Header{}, status: http.StatusOK}
+		fg.handleCalendar(resp, req)
+
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", "<response-"+strings.Trim(part.Header.Get("Content-ID"), "<>")+">")
+		out, err := mw.CreatePart(h)
+		if err != nil {
+			slog.Error("fake Google can't write batch part", "err", err)
+			return
+		}
+		fmt.Fprintf(out, "HTTP/1.1 %d %s\r\n", resp.status, http.StatusText(resp.status))
+		fmt.Fprintf(out, "Content-Type: application/json; charset=UTF-8\r\n")
+		fmt.Fprintf(out, "Content-Length: %d\r\n\r\n", resp.body.Len())
+		out.Write(resp.body.Bytes())
+	}
+	mw.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.Write(body.Bytes())
+}
+
+// fakeResponse records a response to a request within a batch
+type fakeResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (fr *fakeResponse) Header() http.Header         { return fr.header }
+func (fr *fakeResponse) Write(b []byte) (int, error) { return fr.body.Write(b) }
+func (fr *fakeResponse) WriteHeader(status int)      { fr.status = status }
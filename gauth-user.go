@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Users can authorise us to write to their own calendars, rather than
+// sharing calendars with a service account.  This uses the authorisation
+// code flow for installed apps, with the redirect going to a temporary
+// server on the loopback interface.  See:
+// https://developers.google.com/identity/protocols/oauth2/native-app
+
+const DefaultUserTokenUri = "https://oauth2.googleapis.com/token"
+
+// authorizeTimeout limits how long we wait for the user to give consent
+const authorizeTimeout = 5 * time.Minute
+
+// authorizeOutput is where the user is told where to give consent
+var authorizeOutput io.Writer = os.Stdout
+
+// authorizeCommand runs the consent flow for the configured credentials
+func authorizeCommand() error {
+	if GCalClient == nil {
+		return errors.New("no Google Calendar credentials configured")
+	}
+	ga, ok := GCalClient.Transport.(*GAuthenticator)
+	if !ok {
+		return errors.New("Google Calendar client isn't authenticating")
+	}
+
+	return ga.Authorize()
+}
+
+// revokeCommand revokes the stored token and removes it, or just removes
+// it if Google Calendar isn't configured
+func revokeCommand() error {
+	if GCalClient != nil {
+		if ga, ok := GCalClient.Transport.(*GAuthenticator); ok {
+			return ga.Revoke()
+		}
+	}
+
+	if tokenFile := os.Getenv("ICESCRAPER_GCAL_TOKEN_FILE"); tokenFile != "" {
+		return clearStoredToken(tokenFile)
+	}
+	return errors.New("no token file configured")
+}
+
+// Authorize asks the user for consent via their browser, and exchanges
+// the resulting code for tokens, which are stored in the token file
+func (ga *GAuthenticator) Authorize() error {
+	if ga.serviceAccount() {
+		return errors.New("service accounts don't need authorising")
+	}
+	if ga.authUri == "" {
+		return errors.New("credentials aren't for an installed app")
+	}
+	if ga.tokenFile == "" {
+		return errors.New("no token file configured to store authorisation")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return errors.Wrap(err, "listening for redirect")
+	}
+	defer listener.Close()
+	redirectUri := fmt.Sprintf("http://%v/", listener.Addr())
+
+	state, err := randomUrlString(16)
+	if err != nil {
+		return err
+	}
+
+	// PKCE protects the code from being used by anything else
+	// that sees the redirect
+	verifier, err := randomUrlString(32)
+	if err != nil {
+		return err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{}
+	query.Set("client_id", ga.clientId)
+	query.Set("redirect_uri", redirectUri)
+	query.Set("response_type", "code")
+	query.Set("scope", strings.Join(ga.Scopes, " "))
+	query.Set("access_type", "offline")
+	query.Set("prompt", "consent")
+	query.Set("state", state)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	fmt.Fprintln(authorizeOutput, "Visit this URL to authorise access to your calendar:")
+	fmt.Fprintln(authorizeOutput, ga.authUri+"?"+query.Encode())
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	// Only the first redirect is used, so later ones mustn't block
+	// waiting for it to be received
+	send := func(res result) {
+		select {
+		case results <- res:
+		default:
+		}
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case q.Get("state") != state:
+			http.Error(w, "Unexpected state", http.StatusBadRequest)
+			return
+		case q.Get("error") != "":
+			fmt.Fprintln(w, "Authorisation failed, you can close this window.")
+			send(result{err: errors.Errorf("authorisation failed: %v", q.Get("error"))})
+		default:
+			fmt.Fprintln(w, "Authorised, you can close this window.")
+			send(result{code: q.Get("code")})
+		}
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(authorizeTimeout):
+		return errors.New("timed out waiting for authorisation")
+	}
+	if res.err != nil {
+		return res.err
+	}
+
+	args := url.Values{}
+	args.Set("grant_type", "authorization_code")
+	args.Set("code", res.code)
+	args.Set("client_id", ga.clientId)
+	args.Set("client_secret", ga.clientSecret)
+	args.Set("redirect_uri", redirectUri)
+	args.Set("code_verifier", verifier)
+
+	token, validity, err := ga.requestToken(args, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "exchanging authorisation code")
+	}
+	ga.mu.Lock()
+	granted := ga.refreshToken != ""
+	if granted {
+		ga.currentToken, ga.tokenValidity = token, validity
+	}
+	ga.mu.Unlock()
+	if !granted {
+		return errors.New("no refresh token granted")
+	}
+
+	fmt.Fprintln(authorizeOutput, "Authorised, token stored in", ga.tokenFile)
+	return nil
+}
+
+func randomUrlString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generating random string")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
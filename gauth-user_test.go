@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeLoopbackFlow(t *testing.T) {
+	fg, _ := newFakeGoogle(t, 0, false)
+	useFakeCalendar(t, fg)
+	dir := t.TempDir()
+	credFile, tokenFile := filepath.Join(dir, "creds.json"), filepath.Join(dir, "token.json")
+	if err := fg.writeUserCredentials(credFile); err != nil {
+		t.Fatal(err)
+	}
+	ga, err := NewAuthenticator([]string{credFile}, tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, pw := io.Pipe()
+	saved := authorizeOutput
+	t.Cleanup(func() { authorizeOutput = saved })
+	authorizeOutput = pw
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ga.Authorize()
+		pw.Close()
+	}()
+	lines := make(chan string, 10)
+	go func() {
+		s := bufio.NewScanner(pr)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+
+	<-lines
+	authUrl, err := url.Parse(<-lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := authUrl.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("state") == "" {
+		t.Errorf("consent requested without PKCE or state: %v", authUrl)
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Hostname() != "127.0.0.1" {
+		t.Fatalf("redirect to %v, want the loopback interface", q.Get("redirect_uri"))
+	}
+
+	// A redirect without our state is turned away
+	resp, err := http.Get(redirect.String() + "?code=forged&state=wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("redirect with the wrong state gave %v", resp.Status)
+	}
+
+	// Consent is given straight away, and the browser redirected back
+	resp, err = http.Get(authUrl.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "Authorised") {
+		t.Errorf("browser shown %q", body)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("authorising: %v", err)
+	}
+	stored := getStoredToken(tokenFile)
+	if _, ok := fg.refreshTokens[stored.RefreshToken]; !ok || stored.Token == "" {
+		t.Fatalf("stored %+v, want the granted tokens", stored)
+	}
+
+	// Later runs use the stored refresh token for new access tokens
+	ga, err = NewAuthenticator([]string{credFile}, tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ga.InvalidateToken()
+	rt := &recordingTransport{}
+	ga.NextLayer = rt
+	if err := listFakeCalendar(t, &http.Client{Transport: ga}); err != nil {
+		t.Fatalf("listing events with the stored refresh token: %v", err)
+	}
+	if paths := rt.paths(); len(paths) != 2 || paths[0] != "/token" {
+		t.Errorf("requests made %v, want a token refresh and a list", paths)
+	}
+}
@@ -11,99 +11,341 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
-// GAuthenticator encapsulates service account authentication in
+// GAuthenticator encapsulates service account or user authentication in
 // an http.RoundTripper wrapper.  See:
 // https://developers.google.com/identity/protocols/OAuth2ServiceAccount
+// https://developers.google.com/identity/protocols/oauth2/native-app
 type GAuthenticator struct {
-	// Configuration to obtain tokens
-	privateKey  *rsa.PrivateKey
+	// Configuration to obtain tokens.  A service account may have several
+	// keys whilst they're rotated, read from credFiles, and currentKey is
+	// the one which last worked.
+	keys        []serviceKey
+	currentKey  int
+	credFiles   []string
 	clientEmail string
 	tokenUri    string
-	scope       string
 
-	// Once obtained, use this token whilst it is valid
+	// Configuration to obtain tokens on behalf of a user, used instead
+	// of the above if there are no keys
+	clientId     string
+	clientSecret string
+	authUri      string
+	refreshToken string
+
+	// Once obtained, use this token whilst it is valid.  The mutex guards
+	// the token, and inflight is the fetch in progress, if any, so that
+	// concurrent requests share a single fetch.
+	mu            sync.Mutex
 	currentToken  string
 	tokenValidity time.Time
+	inflight      *tokenFetch
 	tokenFile     string
 
-	// Underlying RoundTripper for forwarding request
+	// Scopes are the access requested, by default just DefaultScopes
+	Scopes []string
+
+	// RevokeUri is where tokens are revoked, normally DefaultRevokeUri
+	RevokeUri string
+
+	// RefreshSkew is how long before expiry a token is replaced, so
+	// that requests made just before it expires don't fail
+	RefreshSkew time.Duration
+
+	// Underlying RoundTripper for forwarding request, also used for
+	// token requests
 	NextLayer http.RoundTripper
 }
 
-func NewAuthenticator(credFile, tokenFile string) (*GAuthenticator, error) {
+// tokenFetch is a token request shared by all callers who need a token
+// whilst it is in progress
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// serviceKey is one of a service account's keys, with the id Google
+// knows it by
+type serviceKey struct {
+	id  string
+	key *rsa.PrivateKey
+}
+
+const DefaultRefreshSkew = time.Minute
+
+// DefaultScopes is full access to calendars, as we create and update events
+var DefaultScopes = []string{"https://www.googleapis.com/auth/calendar"}
+
+// googleCredentials is the contents of any of the credentials files we
+// understand
+type googleCredentials struct {
+	// A service credentials file looks like this.  See:
+	// https://console.developers.google.com/apis/credentials
+	Type                    string
+	ProjectId               string `json:"project_id"`
+	PrivateKeyId            string `json:"private_key_id"`
+	PrivateKey              string `json:"private_key"`
+	ClientEmail             string `json:"client_email"`
+	ClientId                string `json:"client_id"`
+	AuthUri                 string `json:"auth_uri"`
+	TokenUri                string `json:"token_uri"`
+	AuthProviderX509CertUrl string `json:"auth_provider_x509_cert_url"`
+	ClientX509CertUrl       string `json:"client_x509_cert_url"`
+
+	// An "authorized_user" file, as written by gcloud, also has these
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+
+	// Whereas an OAuth client credentials file for a desktop app
+	// has its details in here instead
+	Installed *struct {
+		ClientId     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		AuthUri      string `json:"auth_uri"`
+		TokenUri     string `json:"token_uri"`
+	} `json:"installed"`
+}
+
+func readCredentials(credFile string) (googleCredentials, error) {
+	myCreds := googleCredentials{}
+
 	f, err := os.Open(credFile)
 	if err != nil {
-		return nil, errors.Wrap(err, "opening credentials")
+		return myCreds, errors.Wrap(err, "opening credentials")
 	}
 	defer f.Close()
 
 	credsJson, err := ioutil.ReadAll(f)
 	if err != nil {
-		return nil, errors.Wrap(err, "reading credentials")
-	}
-
-	var myCreds struct {
-		// A service credentials file looks like this.  See:
-		// https://console.developers.google.com/apis/credentials
-		Type                    string
-		ProjectId               string `json:"project_id"`
-		PrivateKeyId            string `json:"private_key_id"`
-		PrivateKey              string `json:"private_key"`
-		ClientEmail             string `json:"client_email"`
-		ClientId                string `json:"client_id"`
-		AuthUri                 string `json:"auth_uri"`
-		TokenUri                string `json:"token_uri"`
-		AuthProviderX509CertUrl string `json:"auth_provider_x509_cert_url"`
-		ClientX509CertUrl       string `json:"client_x509_cert_url"`
+		return myCreds, errors.Wrap(err, "reading credentials")
 	}
+
 	if err := json.Unmarshal(credsJson, &myCreds); err != nil {
-		return nil, errors.Wrap(err, "parsing credentials")
+		return myCreds, errors.Wrap(err, "parsing credentials")
+	}
+	return myCreds, nil
+}
+
+// NewAuthenticator creates an authenticator from the credentials files.
+// Only service accounts can have more than one, each holding another key
+// for the same account, so that keys can be rotated without downtime.
+func NewAuthenticator(credFiles []string, tokenFile string) (*GAuthenticator, error) {
+	if len(credFiles) == 0 {
+		return nil, errors.New("no credentials files")
 	}
 
-	rsaKey, err := parsePrivateKey(myCreds.PrivateKey)
+	myCreds, err := readCredentials(credFiles[0])
 	if err != nil {
-		return nil, errors.Wrap(err, "parsing private key")
+		return nil, err
 	}
 
 	gauth := &GAuthenticator{
-		privateKey:  rsaKey,
-		clientEmail: myCreds.ClientEmail,
-		tokenUri:    myCreds.TokenUri,
-		scope:       `https://www.googleapis.com/auth/calendar`,
 		tokenFile:   tokenFile,
-		NextLayer:   http.DefaultTransport,
+		Scopes:      DefaultScopes,
+		RevokeUri:   DefaultRevokeUri,
+		RefreshSkew: DefaultRefreshSkew,
+		NextLayer:   metricsTransport{next: http.DefaultTransport},
+	}
+
+	switch {
+	case myCreds.Type == "service_account":
+		gauth.clientEmail = myCreds.ClientEmail
+		gauth.tokenUri = myCreds.TokenUri
+		gauth.credFiles = credFiles
+		if err := gauth.loadKeys(); err != nil {
+			return nil, err
+		}
+
+	case myCreds.Type == "authorized_user":
+		gauth.clientId = myCreds.ClientId
+		gauth.clientSecret = myCreds.ClientSecret
+		gauth.refreshToken = myCreds.RefreshToken
+		gauth.tokenUri = DefaultUserTokenUri
+
+	case myCreds.Installed != nil:
+		gauth.clientId = myCreds.Installed.ClientId
+		gauth.clientSecret = myCreds.Installed.ClientSecret
+		gauth.authUri = myCreds.Installed.AuthUri
+		gauth.tokenUri = myCreds.Installed.TokenUri
+
+	default:
+		return nil, errors.Errorf("unknown credentials type %q", myCreds.Type)
+	}
+
+	if len(credFiles) > 1 && !gauth.serviceAccount() {
+		return nil, errors.New("only service accounts can have several credentials files")
 	}
 
 	if tokenFile != "" {
 		// preload stored token if we have one
-		gauth.currentToken, gauth.tokenValidity = getStoredToken(tokenFile)
+		stored := getStoredToken(tokenFile)
+		gauth.currentToken, gauth.tokenValidity = stored.Token, stored.Validity
+		if stored.RefreshToken != "" && !gauth.serviceAccount() {
+			gauth.refreshToken = stored.RefreshToken
+		}
 	}
 
 	return gauth, nil
 }
 
+// loadKeys reads the service account's keys from the credentials files,
+// which must all be for the same account
+func (ga *GAuthenticator) loadKeys() error {
+	var keys []serviceKey
+	for _, credFile := range ga.credFiles {
+		myCreds, err := readCredentials(credFile)
+		if err != nil {
+			return errors.Wrap(err, credFile)
+		}
+		if myCreds.Type != "service_account" || myCreds.ClientEmail != ga.clientEmail {
+			return errors.Errorf("%v isn't a key for %v", credFile, ga.clientEmail)
+		}
+
+		rsaKey, err := parsePrivateKey(myCreds.PrivateKey)
+		if err != nil {
+			return errors.Wrapf(err, "parsing private key in %v", credFile)
+		}
+		keys = append(keys, serviceKey{myCreds.PrivateKeyId, rsaKey})
+	}
+
+	ga.keys, ga.currentKey = keys, 0
+	return nil
+}
+
+func (ga *GAuthenticator) serviceAccount() bool {
+	return len(ga.keys) > 0
+}
+
+// RoundTrip adds an access token to a copy of the request, as a
+// RoundTripper mustn't modify the request it is given
 func (ga *GAuthenticator) RoundTrip(req *http.Request) (*http.Response, error) {
-	if !ga.validToken() {
-		if err := ga.getToken(); err != nil {
-			return nil, err
+	token, err := ga.token()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
 		}
+		return nil, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", ga.currentToken))
-	return ga.NextLayer.RoundTrip(req)
+
+	authReq := new(http.Request)
+	*authReq = *req
+	authReq.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		authReq.Header[k] = append([]string(nil), v...)
+	}
+	authReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	return ga.NextLayer.RoundTrip(authReq)
+}
+
+// SetTokenUri overrides the token endpoint given in the credentials, so
+// that tokens can be requested from a stand-in
+func (ga *GAuthenticator) SetTokenUri(uri string) {
+	ga.tokenUri = uri
 }
 
+// postForm makes a token endpoint request through NextLayer, so that it
+// goes the same way as the API requests
+func (ga *GAuthenticator) postForm(uri string, args url.Values) (*http.Response, error) {
+	c := &http.Client{Transport: ga.NextLayer}
+	return c.PostForm(uri, args)
+}
+
+// InvalidateToken discards the current token, so that a new one is
+// fetched for the next request
+func (ga *GAuthenticator) InvalidateToken() {
+	ga.mu.Lock()
+	defer ga.mu.Unlock()
+	ga.currentToken = ""
+}
+
+const DefaultRevokeUri = "https://oauth2.googleapis.com/revoke"
+
+// Revoke asks Google to revoke our tokens, and clears the token store.
+// Revoking the refresh token also revokes its access tokens.
+func (ga *GAuthenticator) Revoke() error {
+	ga.mu.Lock()
+	token := ga.refreshToken
+	if token == "" {
+		token = ga.currentToken
+	}
+	ga.currentToken, ga.refreshToken = "", ""
+	ga.mu.Unlock()
+
+	if token != "" {
+		args := url.Values{}
+		args.Set("token", token)
+		resp, err := ga.postForm(ga.RevokeUri, args)
+		if err != nil {
+			return errors.Wrap(err, "revoking token")
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// Tokens which have already expired can't be revoked, but
+		// that's fine as they're no use to anyone now
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest {
+			return errors.Errorf("revoking token: %v %s", resp.Status, body)
+		}
+	}
+
+	if ga.tokenFile != "" {
+		return clearStoredToken(ga.tokenFile)
+	}
+	return nil
+}
+
+// token returns the current token, fetching a new one if it's due to
+// expire.  Only one fetch is made at a time, with other callers waiting
+// for its result.
+func (ga *GAuthenticator) token() (string, error) {
+	ga.mu.Lock()
+	if ga.validToken() {
+		defer ga.mu.Unlock()
+		return ga.currentToken, nil
+	}
+
+	if fetch := ga.inflight; fetch != nil {
+		ga.mu.Unlock()
+		<-fetch.done
+		return fetch.token, fetch.err
+	}
+
+	fetch := &tokenFetch{done: make(chan struct{})}
+	ga.inflight = fetch
+	ga.mu.Unlock()
+
+	var validity time.Time
+	fetch.token, validity, fetch.err = ga.getToken()
+
+	ga.mu.Lock()
+	if fetch.err == nil {
+		ga.currentToken, ga.tokenValidity = fetch.token, validity
+		tokenRefreshes.Inc("success")
+	} else {
+		tokenRefreshes.Inc("failure")
+	}
+	ga.inflight = nil
+	ga.mu.Unlock()
+
+	close(fetch.done)
+	return fetch.token, fetch.err
+}
+
+// validToken must be called with the mutex held
 func (ga *GAuthenticator) validToken() bool {
-	if ga.currentToken == "" || ga.tokenValidity.Before(time.Now()) {
+	if ga.currentToken == "" || ga.tokenValidity.Before(time.Now().Add(ga.RefreshSkew)) {
 		return false
 	}
 	return true
@@ -111,117 +353,151 @@ func (ga *GAuthenticator) validToken() bool {
 
 const TokenGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
 
-func (ga *GAuthenticator) getToken() error {
+// getToken requests a new access token, returning it and its expiry time
+func (ga *GAuthenticator) getToken() (string, time.Time, error) {
 	now := time.Now()
-	cs, err := jwtClaimset(ga.clientEmail, ga.tokenUri, now)
+
+	if ga.serviceAccount() {
+		return ga.getServiceToken(now)
+	}
+
+	ga.mu.Lock()
+	refreshToken := ga.refreshToken
+	ga.mu.Unlock()
+	if refreshToken == "" {
+		return "", time.Time{}, errors.New("not authorised - run gcal-authorize")
+	}
+
+	args := url.Values{}
+	args.Set("grant_type", "refresh_token")
+	args.Set("refresh_token", refreshToken)
+	args.Set("client_id", ga.clientId)
+	args.Set("client_secret", ga.clientSecret)
+
+	return ga.requestToken(args, now)
+}
+
+// getServiceToken requests a token with each of the service account's
+// keys in turn, starting with the one which last worked, so that a key
+// which has been deleted is skipped.  If none are accepted, the
+// credentials files are read again in case they've been replaced.
+func (ga *GAuthenticator) getServiceToken(now time.Time) (string, time.Time, error) {
+	var lastErr error
+	for reloaded := false; ; reloaded = true {
+		for i := range ga.keys {
+			idx := (ga.currentKey + i) % len(ga.keys)
+			key := ga.keys[idx]
+
+			token, validity, err := ga.requestServiceToken(key, now)
+			if _, rejected := errors.Cause(err).(*tokenError); rejected {
+				slog.Warn("Service account key rejected", "key", key.id, "err", err)
+				lastErr = err
+				continue
+			} else if err != nil {
+				return "", time.Time{}, err
+			}
+
+			if idx != ga.currentKey {
+				slog.Info("Now using service account key", "key", key.id)
+				ga.currentKey = idx
+			}
+			return token, validity, nil
+		}
+
+		if reloaded {
+			return "", time.Time{}, lastErr
+		}
+		if err := ga.loadKeys(); err != nil {
+			return "", time.Time{}, errors.Wrap(err, "reloading credentials")
+		}
+	}
+}
+
+func (ga *GAuthenticator) requestServiceToken(key serviceKey, now time.Time) (string, time.Time, error) {
+	header := jwtHeader(key.id)
+
+	cs, err := jwtClaimset(ga.clientEmail, ga.tokenUri, strings.Join(ga.Scopes, " "), now)
 	if err != nil {
-		return err
+		return "", time.Time{}, err
 	}
 
-	sig, err := signJwt(ga.privateKey, jwtHeader, cs)
+	sig, err := signJwt(key.key, header, cs)
 	if err != nil {
-		return err
+		return "", time.Time{}, err
 	}
 
 	args := url.Values{}
 	args.Set("grant_type", TokenGrantType)
-	args.Set("assertion", fmt.Sprintf("%s.%s.%s", jwtHeader, cs, sig))
+	args.Set("assertion", fmt.Sprintf("%s.%s.%s", header, cs, sig))
+
+	return ga.requestToken(args, now)
+}
+
+// tokenError is a token request rejected by the token endpoint
+type tokenError struct {
+	Code        string
+	Description string
+}
+
+func (e *tokenError) Error() string {
+	return fmt.Sprintf("no-access-token: %v (%v)", e.Code, e.Description)
+}
 
-	resp, err := http.Post(ga.tokenUri, "application/x-www-form-urlencoded", strings.NewReader(args.Encode()))
+// requestToken makes a token request with the given arguments, storing
+// the resulting token if successful
+func (ga *GAuthenticator) requestToken(args url.Values, now time.Time) (string, time.Time, error) {
+	resp, err := ga.postForm(ga.tokenUri, args)
 	if err != nil {
-		return errors.Wrap(err, "requesting access token")
+		return "", time.Time{}, errors.Wrap(err, "requesting access token")
 	}
 	defer resp.Body.Close()
 
 	responseJson, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return errors.Wrap(err, "reading token response")
+		return "", time.Time{}, errors.Wrap(err, "reading token response")
 	}
 
 	var response struct {
-		AccessToken string `json:"access_token"`
-		ExpiresIn   int64  `json:"expires_in"`
-		TokenType   string `json:"token_type"`
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
 
 		// If the request doesn't work, we'll see these
 		Error            string `json:"error"`
 		ErrorDescription string `json:"error_description"`
 	}
 	if err := json.Unmarshal(responseJson, &response); err != nil {
-		return errors.Wrap(err, "parsing token response")
+		return "", time.Time{}, errors.Wrap(err, "parsing token response")
 	}
 
 	// If we got an error, return it
 	if response.Error != "" {
-		return errors.Errorf("no-access-token: %v (%v)", response.Error, response.ErrorDescription)
+		return "", time.Time{}, &tokenError{response.Error, response.ErrorDescription}
 	}
 
 	// We only understand the semantics of Bearer tokens - reject anything else
 	if response.TokenType != "Bearer" {
-		return errors.Errorf("unknown-token-type: %v", response.TokenType)
+		return "", time.Time{}, errors.Errorf("unknown-token-type: %v", response.TokenType)
 	}
 
-	ga.currentToken = response.AccessToken
-	ga.tokenValidity = now.Add(time.Duration(response.ExpiresIn * int64(time.Second)))
+	validity := now.Add(time.Duration(response.ExpiresIn * int64(time.Second)))
 
-	if ga.tokenFile != "" {
-		if err := storeToken(ga.tokenFile, ga.currentToken, ga.tokenValidity); err != nil {
-			return errors.Wrap(err, "can't store access token")
-		}
+	// Refresh tokens are only sometimes replaced
+	ga.mu.Lock()
+	if response.RefreshToken != "" {
+		ga.refreshToken = response.RefreshToken
 	}
+	refreshToken := ga.refreshToken
+	ga.mu.Unlock()
 
-	return nil
-}
-
-// tokenStore represents the small json file used to persist tokens
-// between program runs, thus reducing the number of token requests
-// we need to make
-type tokenStore struct {
-	Token    string
-	Validity time.Time
-}
-
-func getStoredToken(file string) (string, time.Time) {
-	f, err := os.Open(file)
-	if err != nil {
-		log.Print("stored token not retrieved: ", err)
-		return "", time.Time{}
-	}
-	defer f.Close()
-
-	storeJson, err := ioutil.ReadAll(f)
-	if err != nil {
-		log.Print("stored token not readable: ", err)
-		return "", time.Time{}
-	}
-
-	myTokenStore := tokenStore{}
-	if err := json.Unmarshal(storeJson, &myTokenStore); err != nil {
-		log.Print("stored token file malformed: ", err)
-		return "", time.Time{}
-	}
-
-	return myTokenStore.Token, myTokenStore.Validity
-}
-
-func storeToken(file string, token string, validity time.Time) error {
-	f, err := os.Create(file)
-	if err != nil {
-		return errors.Wrap(err, "creating token store file")
-	}
-	defer f.Close()
-
-	myTokenStore := tokenStore{token, validity}
-	storeJson, err := json.Marshal(myTokenStore)
-	if err != nil {
-		return errors.Wrap(err, "marshalling token store")
-	}
-
-	if _, err := f.Write(storeJson); err != nil {
-		return errors.Wrap(err, "writing token store")
+	if ga.tokenFile != "" {
+		if err := storeToken(ga.tokenFile, tokenStore{response.AccessToken, validity, refreshToken}); err != nil {
+			return "", time.Time{}, errors.Wrap(err, "can't store access token")
+		}
 	}
 
-	return nil
+	return response.AccessToken, validity, nil
 }
 
 func parsePrivateKey(pemKey string) (*rsa.PrivateKey, error) {
@@ -230,26 +506,53 @@ func parsePrivateKey(pemKey string) (*rsa.PrivateKey, error) {
 		return nil, errors.New("can't decode private key")
 	}
 
-	if block.Type != "PRIVATE KEY" {
-		return nil, errors.Errorf("unexpected key type %v", block.Type)
+	// Keys are encrypted either with PEM headers (RFC 1423), which are
+	// insecure, or as PKCS#8, neither of which we can decrypt without a
+	// passphrase
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") || block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, errors.New("private key is encrypted - decrypt it with openssl first")
 	}
 
-	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, errors.Wrap(err, "parsing private key")
-	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		// PKCS#8, as in credentials files from Google
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing private key")
+		}
 
-	rsaKey, ok := key.(*rsa.PrivateKey)
-	if !ok {
-		return nil, errors.Errorf("Wrong private key type: %T", key)
-	}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.Errorf("Wrong private key type: %T", key)
+		}
+		return rsaKey, nil
+
+	case "RSA PRIVATE KEY":
+		// PKCS#1, as written by openssl genrsa and some other tools
+		rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing private key")
+		}
+		return rsaKey, nil
 
-	return rsaKey, nil
+	default:
+		return nil, errors.Errorf("unexpected key type %v", block.Type)
+	}
 }
 
-var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+// jwtHeader returns the encoded JWT header, naming the key used to sign
+// it so that Google doesn't have to try each of the account's keys
+func jwtHeader(keyId string) string {
+	j, _ := json.Marshal(struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+		Kid string `json:"kid,omitempty"`
+	}{"RS256", "JWT", keyId})
+
+	return base64.RawURLEncoding.EncodeToString(j)
+}
 
-func jwtClaimset(svcEmail string, audience string, issuedAt time.Time) (string, error) {
+func jwtClaimset(svcEmail string, audience string, scope string, issuedAt time.Time) (string, error) {
 	j, err := json.Marshal(struct {
 		Aud   string `json:"aud"`
 		Exp   int64  `json:"exp"`
@@ -257,7 +560,7 @@ func jwtClaimset(svcEmail string, audience string, issuedAt time.Time) (string,
 		Iss   string `json:"iss"`
 		Scope string `json:"scope"`
 	}{
-		Scope: `https://www.googleapis.com/auth/calendar`,
+		Scope: scope,
 		Aud:   audience,
 		Iss:   svcEmail,
 		Exp:   issuedAt.Add(time.Hour).Unix(),
@@ -265,7 +568,7 @@ func jwtClaimset(svcEmail string, audience string, issuedAt time.Time) (string,
 	})
 
 	if err != nil {
-		log.Print("Can't marshall jwt claimset", err)
+		slog.Error("Can't marshal jwt claimset", "err", err)
 		return "", err
 	}
 
@@ -281,7 +584,7 @@ func signJwt(privateKey *rsa.PrivateKey, header, claimset string) (string, error
 
 	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, d)
 	if err != nil {
-		log.Print("Can't sign digest", err)
+		slog.Error("Can't sign digest", "err", err)
 		return "", err
 	}
 
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GoogleAPIError is the error envelope returned by Google APIs.  See:
+// https://developers.google.com/calendar/v3/errors
+type GoogleAPIError struct {
+	StatusCode int `json:"-"`
+
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Errors  []struct {
+		Domain  string `json:"domain"`
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (e *GoogleAPIError) Error() string {
+	if len(e.Errors) > 0 {
+		return fmt.Sprintf("google api error %d (%v): %v", e.StatusCode, e.Errors[0].Reason, e.Message)
+	}
+	return fmt.Sprintf("google api error %d: %v", e.StatusCode, e.Message)
+}
+
+// HasReason reports whether any of the detailed errors has one of the reasons
+func (e *GoogleAPIError) HasReason(reasons ...string) bool {
+	for _, detail := range e.Errors {
+		for _, r := range reasons {
+			if detail.Reason == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RateLimited reports whether the request should be retried after a delay
+func (e *GoogleAPIError) RateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		(e.StatusCode == http.StatusForbidden && e.HasReason("rateLimitExceeded", "userRateLimitExceeded"))
+}
+
+// Temporary reports whether the failure was on Google's side
+func (e *GoogleAPIError) Temporary() bool {
+	return e.StatusCode >= 500
+}
+
+// Duplicate reports whether an insert failed because the id is in use
+func (e *GoogleAPIError) Duplicate() bool {
+	return e.StatusCode == http.StatusConflict
+}
+
+// parseGoogleAPIError extracts the error from a failed response body,
+// falling back to the raw body if it isn't the usual envelope
+func parseGoogleAPIError(statusCode int, body []byte) *GoogleAPIError {
+	var envelope struct {
+		Error *GoogleAPIError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error == nil {
+		return &GoogleAPIError{StatusCode: statusCode, Code: statusCode, Message: string(body)}
+	}
+
+	envelope.Error.StatusCode = statusCode
+	return envelope.Error
+}
+
+// setGcalApiRoot sends Calendar API requests to another server, such as a
+// stand-in in tests, rather than https://www.googleapis.com
+func setGcalApiRoot(root string) {
+	root = strings.TrimSuffix(root, "/")
+	gcalApiBase = root + gcalBatchPath
+	gcalBatchUrl = root + "/batch" + gcalBatchPath
+}
+
+// tokenInvalidator is implemented by authenticating transports which can
+// be told to discard their current token and fetch another
+type tokenInvalidator interface {
+	InvalidateToken()
+}
+
+// gcalMaxAttempts is the number of times a request is tried before
+// giving up on rate limiting or server errors
+const gcalMaxAttempts = 5
+
+// gcalInitialBackoff is the delay before the first retry, doubling after
+var gcalInitialBackoff = time.Second
+
+// gcalMaxRetryWait limits the time spent waiting to retry a request, as
+// the database is usually locked meanwhile.  A push which would need to
+// wait longer fails, and is queued in the outbox to be retried later.
+var gcalMaxRetryWait = 15 * time.Second
+
+// gcalDo makes a Google API request, returning the response body if
+// successful or a *GoogleAPIError if not.  The token is refreshed and the
+// request retried once on a 401, and rate limiting and server errors are
+// retried with exponential backoff, honouring any Retry-After header, for
+// up to gcalMaxRetryWait.
+func gcalDo(c *http.Client, method, url string, body []byte) ([]byte, error) {
+	_, respData, err := gcalRoundTrip(c, method, url, "application/json", body)
+	return respData, err
+}
+
+// gcalRoundTrip is gcalDo for any content type, also returning the headers
+// of the successful response
+func gcalRoundTrip(c *http.Client, method, url, contentType string, body []byte) (http.Header, []byte, error) {
+	refreshed := false
+	backoff := gcalInitialBackoff
+	var waited time.Duration
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "creating request")
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		resp, err := c.Do(req)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "%v request", method)
+		}
+
+		respData, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode/100 == 2 {
+			return resp.Header, respData, nil
+		}
+
+		apiErr := parseGoogleAPIError(resp.StatusCode, respData)
+
+		if resp.StatusCode == http.StatusUnauthorized && !refreshed {
+			if ti, ok := c.Transport.(tokenInvalidator); ok {
+				slog.Info("Access token rejected, refreshing")
+				ti.InvalidateToken()
+				refreshed = true
+				attempt--
+				continue
+			}
+		}
+
+		if (apiErr.RateLimited() || apiErr.Temporary()) && attempt < gcalMaxAttempts {
+			delay := retryAfter(resp.Header, backoff)
+			if waited+delay <= gcalMaxRetryWait {
+				slog.Warn("Google API request failed, retrying", "err", apiErr, "delay", delay)
+				time.Sleep(delay)
+				waited += delay
+				backoff *= 2
+				continue
+			}
+			slog.Warn("Google API request failed, not waiting to retry", "err", apiErr, "delay", delay)
+		}
+
+		return nil, nil, apiErr
+	}
+}
+
+// retryAfter returns the delay requested by the server, or the backoff
+// with some jitter added if the server didn't say
+func retryAfter(h http.Header, backoff time.Duration) time.Duration {
+	if secs, err := strconv.Atoi(h.Get("Retry-After")); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff)))
+}
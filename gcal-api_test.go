@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// shortenGcalRetries makes retries quick until the end of the test
+func shortenGcalRetries(t *testing.T, backoff, maxWait time.Duration) {
+	savedBackoff, savedWait := gcalInitialBackoff, gcalMaxRetryWait
+	t.Cleanup(func() { gcalInitialBackoff, gcalMaxRetryWait = savedBackoff, savedWait })
+	gcalInitialBackoff, gcalMaxRetryWait = backoff, maxWait
+}
+
+func TestGcalRetries(t *testing.T) {
+	shortenGcalRetries(t, 10*time.Millisecond, 5*time.Second)
+	const unavailable, limited = http.StatusServiceUnavailable, http.StatusTooManyRequests
+
+	for _, tc := range []struct {
+		name     string
+		failures []fakeFailure
+		requests int
+		minWait  time.Duration
+		maxWait  time.Duration
+		check    func(*GoogleAPIError) bool
+	}{
+		{"server errors", []fakeFailure{{unavailable, ""}, {http.StatusInternalServerError, ""}}, 3, 30 * time.Millisecond, time.Second, nil},
+		{"rate limited", []fakeFailure{{limited, ""}}, 2, 10 * time.Millisecond, time.Second, nil},
+		{"retry after", []fakeFailure{{limited, "1"}}, 2, time.Second, 2 * time.Second, nil},
+		{"too many failures", []fakeFailure{{unavailable, ""}, {unavailable, ""}, {unavailable, ""}, {unavailable, ""}, {unavailable, ""}},
+			gcalMaxAttempts, 0, 2 * time.Second, (*GoogleAPIError).Temporary},
+		{"retry after too long", []fakeFailure{{limited, "3600"}}, 1, 0, time.Second, (*GoogleAPIError).RateLimited},
+	} {
+		fg, ga, rt := newFakeServiceAuthenticator(t, 1, false)
+		c := &http.Client{Transport: ga}
+		fg.failures = tc.failures
+
+		start := time.Now()
+		err := listFakeCalendar(t, c)
+		elapsed := time.Since(start)
+
+		if tc.check == nil && err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+		} else if tc.check != nil {
+			if apiErr, ok := errors.Cause(err).(*GoogleAPIError); !ok || !tc.check(apiErr) {
+				t.Errorf("%v: gave %v", tc.name, err)
+			}
+		}
+		if n := len(rt.paths()) - countPaths(rt.paths(), "/token"); n != tc.requests {
+			t.Errorf("%v: %v requests made, want %v", tc.name, n, tc.requests)
+		}
+		if elapsed < tc.minWait || elapsed > tc.maxWait {
+			t.Errorf("%v: took %v, want between %v and %v", tc.name, elapsed, tc.minWait, tc.maxWait)
+		}
+	}
+}
+
+func TestGcalInsertDuplicateUpdates(t *testing.T) {
+	fg, c := newFakeCalendarClient(t)
+	const calendarId = "cal@example.com"
+
+	first, err := makeGCalEvent(testSession(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertCalendarEvent(c, calendarId, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The id is in use, so the insert is rejected with a 409 and the
+	// event updated instead
+	second, err := makeGCalEvent(testSession(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertCalendarEvent(c, calendarId, second); err != nil {
+		t.Fatalf("inserting a duplicate: %v", err)
+	}
+	if got := fakeCalendarEvent(t, fg, calendarId, second.Id); !gcalEventsMatch(second, &got) {
+		t.Errorf("event after inserting a duplicate %+v, want %+v", got, second)
+	}
+}
+
+func TestRateLimitedPushQueued(t *testing.T) {
+	fg, ga, _ := newFakeServiceAuthenticator(t, 1, false)
+	saved := GCalClient
+	t.Cleanup(func() { GCalClient = saved })
+	GCalClient = &http.Client{Transport: ga}
+
+	const calendarId = "cal@example.com"
+	useProducts(t, map[ProductId]ProductConfig{"prod-a": {GCal: calendarId}})
+	fg.failures = []fakeFailure{{http.StatusTooManyRequests, "3600"}}
+
+	// Rather than holding the database for an hour, the push is queued
+	db := openTestDb(t)
+	ev, evCtx := testSession(40)
+	start := time.Now()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		optionallyUpdateCalendar(tx, ev, evCtx, 0)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("push took %v", elapsed)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b == nil || b.Get(outboxItem{Target: gcalTargetPrefix + calendarId, Event: ev}.key()) == nil {
+			t.Errorf("rate limited push not queued")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Google's batch endpoint accepts a multipart/mixed request, each part of
+// which is an http request in its own right, and responds in kind.  See:
+// https://developers.google.com/calendar/v3/batch
+
+var gcalBatchUrl = "https://www.googleapis.com/batch/calendar/v3"
+
+// gcalBatchPath is the prefix of each request path within a batch
+const gcalBatchPath = "/calendar/v3"
+
+// gcalBatchLimit is the maximum number of requests in one batch
+const gcalBatchLimit = 50
+
+// gcalBatchOp is a single request within a batch.  Id is only used to
+// identify the result, and is usually the session id.
+type gcalBatchOp struct {
+	Id     string
+	Method string
+	Path   string
+	Body   []byte
+}
+
+// gcalBatchResult is the outcome of a gcalBatchOp, with Err being a
+// *GoogleAPIError if the request failed
+type gcalBatchResult struct {
+	Op   gcalBatchOp
+	Body []byte
+	Err  error
+}
+
+func eventInsertOp(id, calendarId string, ev *GCalEvent) (gcalBatchOp, error) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return gcalBatchOp{}, errors.Wrap(err, "marshalling new event")
+	}
+	return gcalBatchOp{id, http.MethodPost, fmt.Sprintf("%v/calendars/%v/events", gcalBatchPath, calendarId), data}, nil
+}
+
+func eventUpdateOp(id, calendarId string, ev *GCalEvent) (gcalBatchOp, error) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return gcalBatchOp{}, errors.Wrap(err, "marshalling new event")
+	}
+	return gcalBatchOp{id, http.MethodPut, fmt.Sprintf("%v/calendars/%v/events/%v", gcalBatchPath, calendarId, ev.Id), data}, nil
+}
+
+func eventDeleteOp(id, calendarId, eventId string) gcalBatchOp {
+	return gcalBatchOp{id, http.MethodDelete, fmt.Sprintf("%v/calendars/%v/events/%v", gcalBatchPath, calendarId, eventId), nil}
+}
+
+// gcalBatch sends the operations in batches of up to gcalBatchLimit,
+// returning a result for each in the same order.  Operations which are
+// rate limited or hit server errors are retried in a later batch.
+func gcalBatch(c *http.Client, ops []gcalBatchOp) []gcalBatchResult {
+	results := make([]gcalBatchResult, len(ops))
+	pending := make([]int, len(ops))
+	for i, op := range ops {
+		results[i].Op = op
+		pending[i] = i
+	}
+
+	backoff := gcalInitialBackoff
+	for attempt := 1; len(pending) > 0; attempt++ {
+		var retry []int
+
+		for start := 0; start < len(pending); start += gcalBatchLimit {
+			end := start + gcalBatchLimit
+			if end > len(pending) {
+				end = len(pending)
+			}
+			chunk := pending[start:end]
+
+			batchOps := make([]gcalBatchOp, len(chunk))
+			for i, idx := range chunk {
+				batchOps[i] = ops[idx]
+			}
+
+			chunkResults, err := sendGcalBatch(c, batchOps)
+			for i, idx := range chunk {
+				if err != nil {
+					results[idx].Err = err
+					continue
+				}
+				results[idx].Body, results[idx].Err = chunkResults[i].Body, chunkResults[i].Err
+				if apiErr, ok := results[idx].Err.(*GoogleAPIError); ok && (apiErr.RateLimited() || apiErr.Temporary()) {
+					retry = append(retry, idx)
+				}
+			}
+		}
+
+		if len(retry) == 0 || attempt >= gcalMaxAttempts {
+			break
+		}
+
+		delay := retryAfter(http.Header{}, backoff)
+		slog.Warn("Batched requests failed, retrying", "failed", len(retry), "delay", delay)
+		time.Sleep(delay)
+		backoff *= 2
+		pending = retry
+	}
+
+	return results
+}
+
+// sendGcalBatch sends a single batch request, returning the results in
+// the same order as the operations
+func sendGcalBatch(c *http.Client, ops []gcalBatchOp) ([]gcalBatchResult, error) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+
+	for i, op := range ops {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Type", "application/http")
+		h.Set("Content-ID", fmt.Sprintf("<item-%d>", i))
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating batch part")
+		}
+
+		fmt.Fprintf(part, "%v %v HTTP/1.1\r\n", op.Method, op.Path)
+		if op.Body != nil {
+			fmt.Fprintf(part, "Content-Type: application/json\r\n")
+			fmt.Fprintf(part, "Content-Length: %d\r\n", len(op.Body))
+		}
+		fmt.Fprintf(part, "\r\n")
+		part.Write(op.Body)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, errors.Wrap(err, "finishing batch")
+	}
+
+	header, respData, err := gcalRoundTrip(c, http.MethodPost, gcalBatchUrl,
+		"multipart/mixed; boundary="+mw.Boundary(), body.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "sending batch")
+	}
+
+	_, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return nil, errors.Errorf("unexpected batch response type %q", header.Get("Content-Type"))
+	}
+
+	results := make([]gcalBatchResult, len(ops))
+	seen := make([]bool, len(ops))
+
+	mr := multipart.NewReader(bytes.NewReader(respData), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+
+		// Responses are labelled with the request's Content-ID
+		cid := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		idx, err := strconv.Atoi(strings.TrimPrefix(cid, "response-item-"))
+		if err != nil || idx < 0 || idx >= len(ops) {
+			slog.Warn("Unexpected batch response part", "content_id", cid)
+			continue
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			results[idx].Err = errors.Wrap(err, "parsing batch response part")
+			seen[idx] = true
+			continue
+		}
+		partData, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		results[idx].Body = partData
+		if resp.StatusCode/100 != 2 {
+			results[idx].Err = parseGoogleAPIError(resp.StatusCode, partData)
+		}
+		seen[idx] = true
+	}
+
+	for i := range ops {
+		results[i].Op = ops[i]
+		if !seen[i] {
+			results[i].Err = errors.New("no response in batch")
+		}
+	}
+
+	return results, nil
+}
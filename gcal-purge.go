@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Purging removes the events we created from a calendar, for when a
+// product is withdrawn or mapped to a different calendar.  Our events are
+// recognised by their private extended property, or failing that (for
+// events created before we set it) by their id decoding to a session id.
+
+// purgeCalendarCommand purges the calendar named on the command line
+func purgeCalendarCommand(args []string) error {
+	today := time.Now()
+
+	fs := flag.NewFlagSet("gcal-purge", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the events which would be purged")
+	cancel := fs.Bool("cancel", false, "mark events as cancelled rather than deleting them")
+	product := fs.String("product", "", "only purge events for this product id")
+	from := fs.String("from", today.Format("2006-01-02"), "first day to purge (YYYY-MM-DD)")
+	to := fs.String("to", today.AddDate(1, 0, 0).Format("2006-01-02"), "last day to purge (YYYY-MM-DD)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("specify the calendar id to purge")
+	}
+	calendarId := fs.Arg(0)
+
+	if GCalClient == nil {
+		return errors.New("no Google Calendar credentials configured")
+	}
+
+	// Make sure the timezone is initialised
+	initialiseLocalTimezone()
+
+	timeMin, err := time.ParseInLocation("2006-01-02", *from, localTimezone)
+	if err != nil {
+		return errors.Wrap(err, "parsing start day")
+	}
+	timeMax, err := time.ParseInLocation("2006-01-02", *to, localTimezone)
+	if err != nil {
+		return errors.Wrap(err, "parsing end day")
+	}
+	timeMax = timeMax.AddDate(0, 0, 1)
+
+	events, err := listCalendarEvents(GCalClient, calendarId, timeMin, timeMax)
+	if err != nil {
+		return errors.Wrapf(err, "listing calendar %v", calendarId)
+	}
+
+	var ops []gcalBatchOp
+	for i := range events {
+		ev := &events[i]
+		if ev.Status == "cancelled" {
+			continue
+		}
+
+		sid, ours := scraperEventSession(ev)
+		if !ours {
+			continue
+		}
+		if *product != "" && scraperEventProduct(ev) != ProductId(*product) {
+			continue
+		}
+
+		fmt.Printf("purge %v %v (%v) session %v\n",
+			ev.Start.DateTime.In(localTimezone).Format("2006-01-02 15:04"), ev.Summary, ev.Id, sid)
+
+		if *cancel {
+			ev.Status = "cancelled"
+			op, err := eventUpdateOp(sid, calendarId, ev)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, op)
+		} else {
+			ops = append(ops, eventDeleteOp(sid, calendarId, ev.Id))
+		}
+	}
+
+	if *dryRun || len(ops) == 0 {
+		return nil
+	}
+
+	failures := 0
+	for _, res := range gcalBatch(GCalClient, ops) {
+		if res.Err != nil {
+			slog.Error("Can't purge calendar event", "session", res.Op.Id, "err", res.Err)
+			failures++
+		}
+	}
+
+	slog.Info("Purged calendar events", "purged", len(ops)-failures, "total", len(ops))
+	if failures > 0 {
+		return errors.Errorf("%v of %v purges failed", failures, len(ops))
+	}
+	return nil
+}
+
+// scraperEventSession returns the session an event was created from, and
+// whether it was created by us at all
+func scraperEventSession(ev *GCalEvent) (string, bool) {
+	if ev.ExtendedProperties != nil {
+		if sid := ev.ExtendedProperties.Private[sessionIdProperty]; sid != "" {
+			return sid, true
+		}
+	}
+	return sessionIdFromEventId(ev.Id)
+}
+
+// scraperEventProduct returns the product an event was created for, if
+// it was recorded
+func scraperEventProduct(ev *GCalEvent) ProductId {
+	if ev.ExtendedProperties == nil {
+		return ""
+	}
+	return ProductId(ev.ExtendedProperties.Private[productIdProperty])
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// usePurgeCalendar fills a fake calendar with our events for sessions 1 to
+// 3 of prod-a and 4 of prod-b, one from before we tagged events, and one
+// which isn't ours
+func usePurgeCalendar(t *testing.T) (*fakeGoogle, string) {
+	fg, c := newFakeCalendarClient(t)
+	const calendarId = "cal@example.com"
+
+	saved := GCalClient
+	t.Cleanup(func() { GCalClient = saved })
+	GCalClient = c
+
+	for i, sid := range []string{"1", "2", "3", "4", "5"} {
+		ev, evCtx := testSession(40)
+		ev.SessionId = sid
+		if sid == "4" {
+			evCtx.Product = "prod-b"
+		}
+		calEv, err := makeGCalEvent(ev, evCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sid == "5" {
+			calEv.ExtendedProperties = nil
+		}
+		calEv.Start.DateTime = calEv.Start.DateTime.Add(time.Duration(i) * time.Hour)
+		calEv.End.DateTime = calEv.End.DateTime.Add(time.Duration(i) * time.Hour)
+		if err := insertCalendarEvent(c, calendarId, calEv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	theirs, _ := makeGCalEvent(testSession(40))
+	theirs.Id, theirs.ExtendedProperties = "coachesmeeting", nil
+	if err := insertCalendarEvent(c, calendarId, theirs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure every page is purged
+	fg.pageSize = 2
+	return fg, calendarId
+}
+
+// fakeCalendarStatuses returns the status of each event by session id, or
+// by event id for those which aren't ours
+func fakeCalendarStatuses(fg *fakeGoogle, calendarId string) map[string]string {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	statuses := map[string]string{}
+	for id, ev := range fg.calendars[calendarId] {
+		if sid, ours := scraperEventSession(&ev.GCalEvent); ours {
+			id = sid
+		}
+		statuses[id] = ev.Status
+	}
+	return statuses
+}
+
+func TestPurgeCalendar(t *testing.T) {
+	for _, tc := range []struct {
+		args   []string
+		purged []string
+	}{
+		{[]string{"-dry-run"}, nil},
+		{nil, []string{"1", "2", "3", "4", "5"}},
+		{[]string{"-product", "prod-a"}, []string{"1", "2", "3"}},
+		{[]string{"-cancel", "-product", "prod-b"}, []string{"4"}},
+	} {
+		fg, calendarId := usePurgeCalendar(t)
+		seq := fg.seq
+
+		args := append(tc.args, "-from", "2026-10-19", "-to", "2026-10-19", calendarId)
+		if err := purgeCalendarCommand(args); err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+
+		if len(tc.purged) == 0 && fg.seq != seq {
+			t.Errorf("%v: calendar changed", tc.args)
+		}
+		purged := map[string]bool{}
+		for _, sid := range tc.purged {
+			purged[sid] = true
+		}
+		for id, status := range fakeCalendarStatuses(fg, calendarId) {
+			want := "confirmed"
+			if purged[id] {
+				want = "cancelled"
+			}
+			if status != want {
+				t.Errorf("%v: event %v is %v, want %v", tc.args, id, status, want)
+			}
+		}
+	}
+}
+
+func TestListCalendarEventsPages(t *testing.T) {
+	fg, calendarId := usePurgeCalendar(t)
+	fg.pageSize = 4
+
+	from := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	events, err := listCalendarEvents(GCalClient, calendarId, from, from.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 6 {
+		t.Errorf("listed %v events in pages of %v, want 6", len(events), fg.pageSize)
+	}
+}
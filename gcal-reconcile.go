@@ -0,0 +1,453 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Calendar events are normally only pushed when updateEvent sees a change,
+// so a failed push leaves the calendar out of step with the database.
+// Reconciliation compares every calendar with the stored sessions and
+// makes whatever changes are needed for them to converge.
+
+// reconcileOp is a change needed to bring a calendar event into line
+type reconcileOp struct {
+	Action     string
+	CalendarId string
+	Day        string
+	SessionId  string
+	Event      *GCalEvent
+
+	// retried is set once an insert has become an update or vice versa
+	retried bool
+}
+
+const (
+	opInsert = "insert"
+	opUpdate = "update"
+	opCancel = "cancel"
+)
+
+func (op reconcileOp) String() string {
+	return fmt.Sprintf("%-6v %v %v %v (%v) in %v", op.Action, op.Day,
+		op.Event.Start.DateTime.In(localTimezone).Format("15:04"),
+		op.Event.Summary, op.Event.Id, op.CalendarId)
+}
+
+func reconcileCalendarsCommand(db *bolt.DB, args []string) error {
+	today := time.Now().Format("2006-01-02")
+
+	fs := flag.NewFlagSet("gcal-reconcile", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "print the changes needed without making them")
+	from := fs.String("from", today, "first day to reconcile (YYYY-MM-DD)")
+	to := fs.String("to", "", "last day to reconcile (YYYY-MM-DD), defaults to the last day known")
+	fs.Parse(args)
+
+	if GCalClient == nil {
+		return errors.New("no Google Calendar credentials configured")
+	}
+
+	ops, err := planReconciliation(GCalClient, db, *from, *to)
+	if err != nil {
+		slog.Error("Can't plan reconciliation", "err", err)
+		return err
+	}
+
+	for _, op := range ops {
+		fmt.Println(op)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	failures := applyReconciliation(GCalClient, ops)
+	if failures > 0 {
+		return errors.Errorf("%v of %v changes failed", failures, len(ops))
+	}
+	return nil
+}
+
+// planReconciliation works out the changes needed for every configured
+// calendar to match the stored sessions on the given days
+func planReconciliation(c *http.Client, db *bolt.DB, fromDay, toDay string) ([]reconcileOp, error) {
+	var desired []reconcileOp
+	var leave map[string]bool
+	stored := map[string]storedSession{}
+	if err := db.View(func(tx *bolt.Tx) error {
+		sessions, err := latestSessions(tx, fromDay, toDay)
+		if err != nil {
+			return err
+		}
+		desired, leave = desiredCalendarEvents(tx, sessions)
+		for _, s := range sessions {
+			stored[sessionEventId(s.Event.SessionId)] = s
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "reading sessions")
+	}
+
+	if toDay == "" {
+		toDay = fromDay
+		for _, want := range desired {
+			if want.Day > toDay {
+				toDay = want.Day
+			}
+		}
+	}
+
+	// Make sure the timezone is initialised
+	initialiseLocalTimezone()
+
+	timeMin, err := time.ParseInLocation("2006-01-02", fromDay, localTimezone)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing start day")
+	}
+	timeMax, err := time.ParseInLocation("2006-01-02", toDay, localTimezone)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing end day")
+	}
+	timeMax = timeMax.AddDate(0, 0, 1)
+
+	// Group the desired events by the calendar they belong in
+	wanted := map[string]map[string]reconcileOp{}
+	for _, prodCfg := range productsMap {
+		if prodCfg.GCal != "" {
+			wanted[prodCfg.GCal] = map[string]reconcileOp{}
+		}
+	}
+	for _, want := range desired {
+		wanted[want.CalendarId][want.Event.Id] = want
+	}
+
+	var ops []reconcileOp
+	var strays []strayEvent
+	for calendarId, events := range wanted {
+		existing, err := listCalendarEvents(c, calendarId, timeMin, timeMax)
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing calendar %v", calendarId)
+		}
+
+		for i := range existing {
+			ev := &existing[i]
+			if leave[ev.Id] {
+				continue
+			}
+
+			want, ok := events[ev.Id]
+			if !ok {
+				if s, known := stored[ev.Id]; known {
+					// The session still exists, so its event mustn't be
+					// cancelled, even if the session's product couldn't
+					// be worked out, as for snapshots from before the
+					// product was recorded
+					if s.Product == "" {
+						s.Product = eventProduct(ev, calendarId)
+					}
+					strays = append(strays, strayEvent{calendarId, ev, s})
+					continue
+				}
+
+				// Only touch events we created ourselves
+				if sid, ours := scraperEventSession(ev); ours && ev.Status != "cancelled" {
+					cancelled := *ev
+					cancelled.Status = "cancelled"
+					ops = append(ops, reconcileOp{opCancel, calendarId,
+						ev.Start.DateTime.In(localTimezone).Format("2006-01-02"), sid, &cancelled, false})
+				}
+				continue
+			}
+
+			delete(events, ev.Id)
+			if !gcalEventsMatch(want.Event, ev) {
+				want.Action = opUpdate
+				ops = append(ops, want)
+			}
+		}
+
+		// Anything left isn't in the calendar yet
+		for _, want := range events {
+			if want.Event.Status != "cancelled" {
+				want.Action = opInsert
+				ops = append(ops, want)
+			}
+		}
+	}
+
+	strayOps, err := reconcileStrays(db, strays)
+	if err != nil {
+		return nil, err
+	}
+	ops = append(ops, strayOps...)
+
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].Event.Start.DateTime.Before(ops[j].Event.Start.DateTime)
+	})
+
+	return ops, nil
+}
+
+// strayEvent is an event for a stored session which isn't where the
+// session's product says it should be
+type strayEvent struct {
+	calendarId string
+	event      *GCalEvent
+	session    storedSession
+}
+
+// reconcileStrays updates stray events whose product has now been worked
+// out, if they're in that product's calendar.  The rest are left alone.
+func reconcileStrays(db *bolt.DB, strays []strayEvent) ([]reconcileOp, error) {
+	var ops []reconcileOp
+	err := db.View(func(tx *bolt.Tx) error {
+		for _, stray := range strays {
+			if stray.session.Product == "" {
+				continue
+			}
+			resolved, _ := desiredCalendarEvents(tx, []storedSession{stray.session})
+			if len(resolved) == 0 || resolved[0].CalendarId != stray.calendarId {
+				continue
+			}
+			if !gcalEventsMatch(resolved[0].Event, stray.event) {
+				resolved[0].Action = opUpdate
+				ops = append(ops, resolved[0])
+			}
+		}
+		return nil
+	})
+	return ops, errors.Wrap(err, "reading sessions")
+}
+
+// eventProduct works out which product an event is for, from the product
+// it was created for, or else the calendar it's in if only one product
+// uses that calendar
+func eventProduct(ev *GCalEvent, calendarId string) ProductId {
+	if product := scraperEventProduct(ev); product != "" {
+		return product
+	}
+
+	var found ProductId
+	for pid, prodCfg := range productsMap {
+		if prodCfg.GCal == calendarId {
+			if found != "" {
+				return ""
+			}
+			found = pid
+		}
+	}
+	return found
+}
+
+// desiredCalendarEvents converts sessions into the events they should have
+// in their calendars, after applying the edit policy.  The ids of events
+// which the policy says to leave alone are returned in leave.
+func desiredCalendarEvents(tx *bolt.Tx, sessions []storedSession) ([]reconcileOp, map[string]bool) {
+	var desired []reconcileOp
+	leave := map[string]bool{}
+
+	for _, s := range sessions {
+		calendarId := productsMap[s.Product].GCal
+		if calendarId == "" {
+			continue
+		}
+
+		calEv, err := makeGCalEvent(s.Event, s.EventContext)
+		if err != nil {
+			slog.Error("Can't convert calendar event", "err", err)
+			continue
+		}
+
+		if !applyEditPolicy(calEv, getExternalEdit(tx, calendarId, calEv.Id)) {
+			leave[calEv.Id] = true
+			continue
+		}
+
+		desired = append(desired, reconcileOp{CalendarId: calendarId, Day: s.Day, SessionId: s.Event.SessionId, Event: calEv})
+	}
+
+	return desired, leave
+}
+
+// gcalEventsMatch compares the fields we set on an event with those in the
+// calendar.  Google reports events without a status as "confirmed", and
+// may not report anything but the status for cancelled events.
+// Reminders and extended properties are compared too, so that changes to
+// them in the products file reach events which are otherwise unchanged.
+func gcalEventsMatch(want, got *GCalEvent) bool {
+	wantStatus := want.Status
+	if wantStatus == "" {
+		wantStatus = "confirmed"
+	}
+	if wantStatus == "cancelled" && got.Status == "cancelled" {
+		return true
+	}
+
+	return want.Summary == got.Summary &&
+		want.Description == got.Description &&
+		want.Location == got.Location &&
+		want.ColorId == got.ColorId &&
+		want.Start.DateTime.Equal(got.Start.DateTime) &&
+		want.End.DateTime.Equal(got.End.DateTime) &&
+		wantStatus == got.Status &&
+		gcalRemindersMatch(want.Reminders, got.Reminders) &&
+		gcalPropertiesMatch(want.ExtendedProperties, got.ExtendedProperties)
+}
+
+// gcalRemindersMatch compares reminders, where an event without any set
+// uses the calendar's defaults, as Google reports
+func gcalRemindersMatch(want, got *GCalReminders) bool {
+	if want == nil {
+		want = &GCalReminders{UseDefault: true}
+	}
+	if got == nil {
+		got = &GCalReminders{UseDefault: true}
+	}
+	if want.UseDefault != got.UseDefault || len(want.Overrides) != len(got.Overrides) {
+		return false
+	}
+
+	remaining := map[GCalReminder]int{}
+	for _, r := range want.Overrides {
+		remaining[r]++
+	}
+	for _, r := range got.Overrides {
+		if remaining[r] == 0 {
+			return false
+		}
+		remaining[r]--
+	}
+	return true
+}
+
+// gcalPropertiesMatch checks that the event has the private extended
+// properties we set, ignoring any others
+func gcalPropertiesMatch(want, got *GCalExtendedProperties) bool {
+	if want == nil {
+		return true
+	}
+	for k, v := range want.Private {
+		if got == nil || got.Private[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// applyReconciliation makes the planned changes in batches, returning the
+// number which failed
+func applyReconciliation(c *http.Client, ops []reconcileOp) int {
+	failures := 0
+	for i, err := range applyCalendarOps(c, ops) {
+		if err != nil {
+			slog.Error("Can't reconcile calendar event", "action", ops[i].Action, "session", ops[i].SessionId, "err", err)
+			failures++
+		}
+	}
+	return failures
+}
+
+// applyCalendarOps makes the changes in batches, returning the error from
+// each, if any, in the same order.  Updates of missing events become
+// inserts, and inserts of existing events become updates.
+func applyCalendarOps(c *http.Client, ops []reconcileOp) []error {
+	errs := make([]error, len(ops))
+	pending := make([]int, len(ops))
+	for i := range ops {
+		pending[i] = i
+	}
+
+	for len(pending) > 0 {
+		var batchOps []gcalBatchOp
+		var batched []int
+		for _, i := range pending {
+			op := ops[i]
+			var bop gcalBatchOp
+			var err error
+			switch op.Action {
+			case opInsert:
+				bop, err = eventInsertOp(op.SessionId, op.CalendarId, op.Event)
+			default:
+				bop, err = eventUpdateOp(op.SessionId, op.CalendarId, op.Event)
+			}
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			batchOps = append(batchOps, bop)
+			batched = append(batched, i)
+		}
+
+		var fallbacks []int
+		for n, res := range gcalBatch(c, batchOps) {
+			i := batched[n]
+			op := &ops[i]
+			if res.Err == nil {
+				continue
+			}
+
+			if apiErr, ok := res.Err.(*GoogleAPIError); ok && !op.retried {
+				switch {
+				case op.Action == opInsert && apiErr.Duplicate():
+					op.Action, op.retried = opUpdate, true
+					fallbacks = append(fallbacks, i)
+					continue
+				case op.Action == opUpdate && apiErr.StatusCode == http.StatusNotFound:
+					op.Action, op.retried = opInsert, true
+					fallbacks = append(fallbacks, i)
+					continue
+				}
+			}
+
+			errs[i] = res.Err
+		}
+
+		pending = fallbacks
+	}
+
+	return errs
+}
+
+// backfillCalendarsCommand pushes the latest details of every session in
+// the range to its calendar, whether or not it has changed.  Unlike
+// reconciliation it doesn't need to list the calendars first.
+func backfillCalendarsCommand(db *bolt.DB, args []string) error {
+	today := time.Now().Format("2006-01-02")
+
+	fs := flag.NewFlagSet("gcal-backfill", flag.ExitOnError)
+	from := fs.String("from", today, "first day to backfill (YYYY-MM-DD)")
+	to := fs.String("to", "", "last day to backfill (YYYY-MM-DD), defaults to the last day known")
+	fs.Parse(args)
+
+	if GCalClient == nil {
+		return errors.New("no Google Calendar credentials configured")
+	}
+
+	var ops []reconcileOp
+	if err := db.View(func(tx *bolt.Tx) error {
+		sessions, err := latestSessions(tx, *from, *to)
+		if err != nil {
+			return err
+		}
+		ops, _ = desiredCalendarEvents(tx, sessions)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "reading sessions")
+	}
+	for i := range ops {
+		ops[i].Action = opUpdate
+	}
+
+	failures := applyReconciliation(GCalClient, ops)
+	slog.Info("Backfilled calendar events", "backfilled", len(ops)-failures, "total", len(ops))
+	if failures > 0 {
+		return errors.Errorf("%v of %v changes failed", failures, len(ops))
+	}
+	return nil
+}
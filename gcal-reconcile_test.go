@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGcalEventsMatch(t *testing.T) {
+	ev, evCtx := testSession(40)
+	want, err := makeGCalEvent(ev, evCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(got *GCalEvent)
+		match  bool
+	}{
+		{"unchanged", func(got *GCalEvent) {}, true},
+		{"cancelled", func(got *GCalEvent) { got.Status = "cancelled" }, false},
+		{"summary", func(got *GCalEvent) { got.Summary = "Edited" }, false},
+		{"colour", func(got *GCalEvent) { got.ColorId = "5" }, false},
+		{"default reminders", func(got *GCalEvent) { got.Reminders = &GCalReminders{UseDefault: true} }, true},
+		{"reminders", func(got *GCalEvent) {
+			got.Reminders = &GCalReminders{Overrides: []GCalReminder{{"popup", 30}}}
+		}, false},
+		{"other property", func(got *GCalEvent) { got.ExtendedProperties.Private["other"] = "x" }, true},
+		{"product property", func(got *GCalEvent) { got.ExtendedProperties.Private[productIdProperty] = "prod-b" }, false},
+		{"no properties", func(got *GCalEvent) { got.ExtendedProperties = nil }, false},
+	}
+	for _, test := range tests {
+		// Google reports the status, and gives the event its own copy of
+		// the properties
+		got := *want
+		got.Status = "confirmed"
+		got.ExtendedProperties = &GCalExtendedProperties{Private: map[string]string{}}
+		for k, v := range want.ExtendedProperties.Private {
+			got.ExtendedProperties.Private[k] = v
+		}
+		test.change(&got)
+		if match := gcalEventsMatch(want, &got); match != test.match {
+			t.Errorf("%v: match %v, want %v", test.name, match, test.match)
+		}
+	}
+
+	// Reminders match regardless of their order
+	want.Reminders = &GCalReminders{Overrides: []GCalReminder{{"popup", 30}, {"email", 60}}}
+	got := *want
+	got.Status = "confirmed"
+	got.Reminders = &GCalReminders{Overrides: []GCalReminder{{"email", 60}, {"popup", 30}}}
+	if !gcalEventsMatch(want, &got) {
+		t.Errorf("reminders in another order don't match")
+	}
+}
+
+func TestPlanReconciliation(t *testing.T) {
+	fg, c := newFakeCalendarClient(t)
+	const calendarId = "cal@example.com"
+	useProducts(t, map[ProductId]ProductConfig{"prod-a": {GCal: calendarId}})
+	saved := GCalClient
+	t.Cleanup(func() { GCalClient = saved })
+	GCalClient = c
+
+	db := openTestDb(t)
+	session := func(sid string, spaces int) (timestampedEventInfo, EventContext) {
+		ev, evCtx := testSession(spaces)
+		ev.SessionId = sid
+		return ev, evCtx
+	}
+	push := func(ev timestampedEventInfo, evCtx EventContext) {
+		calEv, err := makeGCalEvent(ev, evCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := insertCalendarEvent(c, calendarId, calEv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1 is up to date, 2 has changed since it was pushed, 3 has never
+	// been pushed, 4 has gone from the site and 5 was cancelled before it
+	// was pushed
+	for _, sid := range []string{"1", "2", "3", "5"} {
+		ev, evCtx := session(sid, 40)
+		ev.Cancelled = sid == "5"
+		putTestSnapshots(t, db, evCtx.Day, evCtx.Product, ev)
+		if sid == "1" {
+			push(ev, evCtx)
+		}
+	}
+	push(session("2", 50))
+	push(session("4", 40))
+	theirs, _ := makeGCalEvent(session("6", 40))
+	theirs.Id, theirs.ExtendedProperties = "coachesmeeting", nil
+	if err := insertCalendarEvent(c, calendarId, theirs); err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := planReconciliation(c, db, "2026-10-19", "2026-10-19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := map[string]string{}
+	for _, op := range ops {
+		actions[op.SessionId] = op.Action
+	}
+	want := map[string]string{"2": opUpdate, "3": opInsert, "4": opCancel}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Errorf("planned %v, want %v", actions, want)
+	}
+
+	// A dry run changes nothing
+	seq := fg.seq
+	args := []string{"-from", "2026-10-19", "-to", "2026-10-19"}
+	if err := reconcileCalendarsCommand(db, append([]string{"-dry-run"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	if fg.seq != seq {
+		t.Errorf("dry run changed the calendar")
+	}
+
+	// Once reconciled, there's nothing left to do
+	if err := reconcileCalendarsCommand(db, args); err != nil {
+		t.Fatal(err)
+	}
+	if ops, err := planReconciliation(c, db, "2026-10-19", "2026-10-19"); err != nil || len(ops) != 0 {
+		t.Errorf("after reconciling, planned %v (%v)", ops, err)
+	}
+	if got := fakeCalendarEvent(t, fg, calendarId, "coachesmeeting"); got.Status != "confirmed" {
+		t.Errorf("someone else's event is %v", got.Status)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Coaches sometimes edit or delete our events by hand.  Incremental sync
+// finds events changed since the last sync, and any of ours which no
+// longer match the stored session are recorded as edited, so that the
+// edit policy can decide what to do when we next push the event.  See:
+// https://developers.google.com/calendar/v3/sync
+
+var gcalSyncBucket = []byte("gcal-sync")
+
+// externalEdit records a change made to one of our events by someone else
+type externalEdit struct {
+	SessionId  string
+	Deleted    bool
+	Notes      string
+	DetectedAt time.Time
+}
+
+// Edit policies decide what happens to events that have been edited
+const (
+	// overwritePolicy replaces edits and recreates deleted events
+	overwritePolicy = "overwrite"
+	// respectDeletionsPolicy leaves deleted events deleted
+	respectDeletionsPolicy = "respect-deletions"
+	// mergeNotesPolicy leaves deleted events deleted, and keeps any
+	// notes added to the description
+	mergeNotesPolicy = "merge-notes"
+)
+
+func gcalEditPolicy() string {
+	if p := os.Getenv("ICESCRAPER_GCAL_EDIT_POLICY"); p != "" {
+		return p
+	}
+	return overwritePolicy
+}
+
+// checkGcalEditPolicy rejects an edit policy we don't know, rather than
+// quietly overwriting edits the user asked us to keep
+func checkGcalEditPolicy() error {
+	switch p := gcalEditPolicy(); p {
+	case overwritePolicy, respectDeletionsPolicy, mergeNotesPolicy:
+		return nil
+	default:
+		return errors.Errorf("unknown edit policy %q", p)
+	}
+}
+
+// notesMarker separates our description from notes added by hand
+const notesMarker = "--- Notes ---"
+
+// syncCalendars runs an incremental sync of every configured calendar
+func syncCalendars(db *bolt.DB) error {
+	if GCalClient == nil {
+		return nil
+	}
+
+	calendars := map[string]bool{}
+	for _, prodCfg := range productsMap {
+		if prodCfg.GCal != "" {
+			calendars[prodCfg.GCal] = true
+		}
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for calendarId := range calendars {
+			if err := syncCalendar(GCalClient, tx, calendarId); err != nil {
+				return errors.Wrapf(err, "syncing calendar %v", calendarId)
+			}
+		}
+		return nil
+	})
+}
+
+func syncCalendar(c *http.Client, tx *bolt.Tx, calendarId string) error {
+	root, err := tx.CreateBucketIfNotExists(gcalSyncBucket)
+	if err != nil {
+		return errors.Wrap(err, "creating sync bucket")
+	}
+	b, err := root.CreateBucketIfNotExists([]byte(calendarId))
+	if err != nil {
+		return errors.Wrap(err, "creating calendar sync bucket")
+	}
+	edits, err := b.CreateBucketIfNotExists([]byte("edits"))
+	if err != nil {
+		return errors.Wrap(err, "creating edits bucket")
+	}
+	days, err := b.CreateBucketIfNotExists([]byte("days"))
+	if err != nil {
+		return errors.Wrap(err, "creating event days bucket")
+	}
+
+	token := string(b.Get([]byte("token")))
+
+	events, nextToken, err := listChangedEvents(c, calendarId, token)
+	if apiErr, ok := errors.Cause(err).(*GoogleAPIError); ok && apiErr.StatusCode == http.StatusGone {
+		// The token has expired, so start again from scratch
+		slog.Info("Sync token expired, running full sync", "calendar", calendarId)
+		token = ""
+		events, nextToken, err = listChangedEvents(c, calendarId, token)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A full sync only establishes where we are, and the days of our
+	// events, as we can't tell which differences are edits rather than
+	// pushes which failed
+	for i := range events {
+		day, err := eventDay(days, &events[i])
+		if err != nil {
+			return err
+		}
+		if token != "" && day != "" {
+			if err := checkForEdit(tx, edits, day, &events[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return b.Put([]byte("token"), []byte(nextToken))
+}
+
+// listChangedEvents returns the events changed since the sync token was
+// issued, or all events if it's empty, along with the next sync token
+func listChangedEvents(c *http.Client, calendarId, token string) ([]GCalEvent, string, error) {
+	var events []GCalEvent
+
+	query := url.Values{}
+	query.Set("maxResults", "2500")
+	if token != "" {
+		query.Set("syncToken", token)
+	} else {
+		query.Set("showDeleted", "true")
+	}
+
+	for {
+		u := gcalApiBase + "/calendars/" + calendarId + "/events?" + query.Encode()
+
+		jsonData, err := gcalDo(c, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "listing changed events")
+		}
+
+		var page struct {
+			Items         []GCalEvent
+			NextPageToken string
+			NextSyncToken string
+		}
+		if err := json.Unmarshal(jsonData, &page); err != nil {
+			return nil, "", errors.Wrap(err, "parsing event list")
+		}
+
+		events = append(events, page.Items...)
+		if page.NextPageToken == "" {
+			return events, page.NextSyncToken, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// checkForEdit compares a changed event with what we'd have pushed for
+// the stored session, recording an edit if they differ
+func checkForEdit(tx *bolt.Tx, edits *bolt.Bucket, day string, ev *GCalEvent) error {
+	sid, ours := scraperEventSession(ev)
+	if !ours {
+		return nil
+	}
+
+	session, err := findSession(tx, day, sid)
+	if err == ErrNoSuchEvent {
+		// Not one we know about, so nothing to protect
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	want, err := makeGCalEvent(session.Event, session.EventContext)
+	if err != nil {
+		return err
+	}
+	// Compare with the event as we'd push it, without any notes kept
+	applyEditPolicy(want, nil)
+
+	edit := externalEdit{SessionId: sid, DetectedAt: time.Now()}
+	switch {
+	case ev.Status == "cancelled" && want.Status != "cancelled":
+		edit.Deleted = true
+	case ev.Status != "cancelled" && !gcalEventsMatch(want, ev):
+		edit.Notes = extractNotes(ev.Description)
+	default:
+		// It matches what we pushed, so isn't (or is no longer) edited
+		return edits.Delete([]byte(ev.Id))
+	}
+
+	sessionLogger(session.Day, session.Product, sid).Info("Calendar event edited externally", "event", ev.Id, "deleted", edit.Deleted)
+
+	editJson, err := json.Marshal(edit)
+	if err != nil {
+		return errors.Wrap(err, "marshalling edit")
+	}
+	return edits.Put([]byte(ev.Id), editJson)
+}
+
+// eventDay returns the day of one of our events.  Deleted events come
+// without their start, so the day each event was last seen on is kept
+// in days.  It's empty for events which aren't ours, or which were
+// deleted before we saw them.
+func eventDay(days *bolt.Bucket, ev *GCalEvent) (string, error) {
+	if _, ours := scraperEventSession(ev); !ours {
+		return "", nil
+	}
+	if ev.Start.DateTime.IsZero() {
+		return string(days.Get([]byte(ev.Id))), nil
+	}
+
+	initialiseLocalTimezone()
+	day := ev.Start.DateTime.In(localTimezone).Format("2006-01-02")
+	return day, errors.Wrap(days.Put([]byte(ev.Id), []byte(day)), "storing event day")
+}
+
+// findSession finds the latest snapshot of a session on the day
+func findSession(tx *bolt.Tx, day, sid string) (storedSession, error) {
+	sessions, err := latestSessions(tx, day, day)
+	if err != nil {
+		return storedSession{}, err
+	}
+	for _, s := range sessions {
+		if s.Event.SessionId == sid {
+			return s, nil
+		}
+	}
+	return storedSession{}, ErrNoSuchEvent
+}
+
+// extractNotes returns the notes added to a description by hand, which
+// are those after the notes marker.  Anything else which differs from
+// ours may be a push of ours which hasn't caught up yet, so isn't kept.
+func extractNotes(description string) string {
+	if i := strings.Index(description, notesMarker); i >= 0 {
+		return strings.TrimSpace(description[i+len(notesMarker):])
+	}
+	return ""
+}
+
+// getExternalEdit returns any edit recorded for the event, or nil
+func getExternalEdit(tx *bolt.Tx, calendarId, eventId string) *externalEdit {
+	if tx == nil {
+		return nil
+	}
+	root := tx.Bucket(gcalSyncBucket)
+	if root == nil {
+		return nil
+	}
+	b := root.Bucket([]byte(calendarId))
+	if b == nil {
+		return nil
+	}
+	edits := b.Bucket([]byte("edits"))
+	if edits == nil {
+		return nil
+	}
+
+	editJson := edits.Get([]byte(eventId))
+	if editJson == nil {
+		return nil
+	}
+	edit := &externalEdit{}
+	if err := json.Unmarshal(editJson, edit); err != nil {
+		slog.Error("Can't parse external edit", "event", eventId, "err", err)
+		return nil
+	}
+	return edit
+}
+
+// applyEditPolicy adjusts the event according to the edit policy, and
+// reports whether it should be pushed at all.  With merge-notes, our
+// description always ends with the notes marker, so there's somewhere
+// to add notes.
+func applyEditPolicy(calEv *GCalEvent, edit *externalEdit) bool {
+	switch gcalEditPolicy() {
+	case respectDeletionsPolicy:
+		return edit == nil || !edit.Deleted
+	case mergeNotesPolicy:
+		if edit != nil && edit.Deleted {
+			return false
+		}
+		calEv.Description += "\n" + notesMarker + "\n"
+		if edit != nil && edit.Notes != "" {
+			calEv.Description += edit.Notes + "\n"
+		}
+		return true
+	default:
+		return true
+	}
+}
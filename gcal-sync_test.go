@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestEventDayOfDeletedEvent(t *testing.T) {
+	db, _ := newTestDay(t)
+
+	calEv, err := makeGCalEvent(testSession(40))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Incremental sync only gives the id of a deleted event
+	deleted := &GCalEvent{Id: calEv.Id, Status: "cancelled"}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		days, err := tx.CreateBucket([]byte("days"))
+		if err != nil {
+			return err
+		}
+
+		if day, err := eventDay(days, deleted); err != nil || day != "" {
+			t.Errorf("day %q of an event never seen, want none", day)
+		}
+		if day, err := eventDay(days, calEv); err != nil || day != "2026-10-19" {
+			t.Errorf("day %q (%v) of an event, want 2026-10-19", day, err)
+		}
+		if day, err := eventDay(days, deleted); err != nil || day != "2026-10-19" {
+			t.Errorf("day %q (%v) of a deleted event, want 2026-10-19", day, err)
+		}
+		if day, _ := eventDay(days, &GCalEvent{Id: "someone-elses", Start: calEv.Start}); day != "" {
+			t.Errorf("day %q of an event which isn't ours, want none", day)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckGcalEditPolicy(t *testing.T) {
+	for policy, ok := range map[string]bool{"": true, "merge-notes": true, "respect-deletion": false} {
+		t.Setenv("ICESCRAPER_GCAL_EDIT_POLICY", policy)
+		if err := checkGcalEditPolicy(); (err == nil) != ok {
+			t.Errorf("policy %q gave %v", policy, err)
+		}
+	}
+}
+
+func TestMergeNotesIgnoresLaggingPushes(t *testing.T) {
+	t.Setenv("ICESCRAPER_GCAL_EDIT_POLICY", mergeNotesPolicy)
+	fg, c := newFakeCalendarClient(t)
+	const calendarId = "cal@example.com"
+
+	db := openTestDb(t)
+	current, evCtx := testSession(40)
+	putTestSnapshots(t, db, evCtx.Day, evCtx.Product, current)
+
+	// Our push of an earlier snapshot, which failed and is still queued
+	stale, _ := testSession(50)
+	staleEv, err := makeGCalEvent(stale, evCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyEditPolicy(staleEv, nil)
+	if err := insertCalendarEvent(c, calendarId, staleEv); err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func() *externalEdit {
+		t.Helper()
+		var edit *externalEdit
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := syncCalendar(c, tx, calendarId); err != nil {
+				return err
+			}
+			edit = getExternalEdit(tx, calendarId, staleEv.Id)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return edit
+	}
+	sync()
+
+	// The queued push is retried, and differs from the stored session,
+	// but its generated lines aren't notes
+	if err := updateCalendarEvent(c, calendarId, staleEv); err != nil {
+		t.Fatal(err)
+	}
+	if edit := sync(); edit != nil && edit.Notes != "" {
+		t.Errorf("lagging push recorded with notes %q", edit.Notes)
+	}
+
+	// A coach adds a note below the marker
+	noted := fakeCalendarEvent(t, fg, calendarId, staleEv.Id)
+	noted.Description += "Bring skates\n"
+	if err := updateCalendarEvent(c, calendarId, &noted); err != nil {
+		t.Fatal(err)
+	}
+	edit := sync()
+	if edit == nil || edit.Deleted || edit.Notes != "Bring skates" {
+		t.Fatalf("edit recorded as %+v, want the note", edit)
+	}
+
+	// When we next push, our generated lines are replaced but the note
+	// is kept
+	calEv, err := makeGCalEvent(current, evCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyEditPolicy(calEv, edit)
+	if strings.Contains(calEv.Description, "50 other booked") || !strings.Contains(calEv.Description, "60 other booked") ||
+		strings.Count(calEv.Description, notesMarker) != 1 || !strings.HasSuffix(calEv.Description, notesMarker+"\nBring skates\n") {
+		t.Errorf("pushed description:\n%v", calEv.Description)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/mhp/ice-scraper
 
-go 1.12
+go 1.21
 
 require (
 	github.com/boltdb/bolt v1.3.1
@@ -3,8 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-	"net/http"
+	"log/slog"
 	"regexp"
 	"strconv"
 	"time"
@@ -16,27 +15,28 @@ func checkForNewDays(db *bolt.DB) error {
 	today := time.Now()
 	thisMonth := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.Local)
 
-	c := &http.Client{}
+	c := newBookingClient()
+	defer c.schema.save(db)
 
 	// Check this month and next for practice ice events...
 	for _, month := range []time.Time{
 		thisMonth,
 		thisMonth.AddDate(0, 1, 0),
 	} {
-		log.Println("Checking", month)
+		slog.Debug("Checking calendar", "month", month.Format("2006-01"))
 		dwi, err := checkIceCalendar(c, month.Month(), month.Year())
 		if err != nil {
-			log.Println("Can't check calendar", month.Month(), "/", month.Year(), err)
+			slog.Error("Can't check calendar", "month", month.Format("2006-01"), "err", err)
 			return err
 		}
 
 		newDays, err := addDays(db, dwi)
 		if err != nil {
-			log.Println("Can't add days to db", err)
+			slog.Error("Can't add days to db", "err", err)
 			return err
 		}
 		if len(newDays) > 0 {
-			log.Println("Added", len(newDays), "new days")
+			slog.Info("Added new days", "days", len(newDays))
 		}
 	}
 	return nil
@@ -44,6 +44,14 @@ func checkForNewDays(db *bolt.DB) error {
 
 type DayKey []byte
 
+// dayKeyRe matches the names of the per-day buckets.  Other buckets
+// live alongside them in the root, so must be skipped when iterating.
+var dayKeyRe = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+
+func isDayKey(k []byte) bool {
+	return dayKeyRe.Match(k)
+}
+
 // addDays iterates over DaysWithIce, adding new ones to the database
 // and returning a list of newly added keys
 func addDays(db *bolt.DB, dwi DaysWithIce) ([]DayKey, error) {
@@ -89,7 +97,7 @@ func addDays(db *bolt.DB, dwi DaysWithIce) ([]DayKey, error) {
 // DaysWithIce is a map of times representing days to a list of products available on that day
 type DaysWithIce map[time.Time][]ProductId
 
-func checkIceCalendar(c *http.Client, month time.Month, year int) (DaysWithIce, error) {
+func checkIceCalendar(c bookingClient, month time.Month, year int) (DaysWithIce, error) {
 	dwi := make(DaysWithIce)
 
 	for _, product := range products() {
@@ -5,8 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"net/http"
+	"log/slog"
 	"strings"
 	"time"
 
@@ -16,26 +15,41 @@ import (
 type EventContext struct {
 	Day     string
 	Product ProductId
+
+	// History holds earlier snapshots of the session, oldest first, for
+	// use by event templates.  It's only filled in where readily available.
+	History []timestampedEventInfo `json:"-"`
+
+	// newEvents collects the calendar events of newly found sessions, if
+	// they're to be inserted in batches
+	newEvents *gcalInsertBatch
 }
 
-// timestampedEventInfo embeds the EventInfo with an additional timestamp
+// timestampedEventInfo embeds the EventInfo with an additional timestamp.
+// Product was added later, so older snapshots may not have it recorded.
 type timestampedEventInfo struct {
 	EventInfo
 	UpdatedAt time.Time
 	Cancelled bool
+	Product   ProductId `json:",omitempty"`
 }
 
 func checkForEvents(db *bolt.DB, onlyToday bool) error {
 	today := time.Now()
 	todayKey := []byte(fmt.Sprintf("%04d-%02d-%02d", today.Year(), today.Month(), today.Day()))
 
-	client := &http.Client{}
+	client := newBookingClient()
+	// Saved separately, so that broken responses are kept when this fails
+	defer client.schema.save(db)
 
 	return db.Update(func(tx *bolt.Tx) error {
 		c := tx.Cursor()
 		evCtx := EventContext{}
 
 		for day, _ := c.Seek(todayKey); day != nil; day, _ = c.Next() {
+			if !isDayKey(day) {
+				continue
+			}
 			evCtx.Day = string(day)
 			b := tx.Bucket(day)
 			if b == nil {
@@ -62,9 +76,12 @@ func checkIfEventsStartingSoon(db *bolt.DB) error {
 	today := time.Now()
 	todayKey := []byte(fmt.Sprintf("%04d-%02d-%02d", today.Year(), today.Month(), today.Day()))
 
+	client := newBookingClient()
+	defer client.schema.save(db)
+
 	return db.Update(func(tx *bolt.Tx) error {
 		b, _ := tx.Cursor().Seek(todayKey)
-		if b == nil {
+		if b == nil || !isDayKey(b) {
 			// No events today!
 			return nil
 		}
@@ -100,7 +117,6 @@ func checkIfEventsStartingSoon(db *bolt.DB) error {
 		})
 
 		if eventStartingSoon {
-			client := &http.Client{}
 			evCtx := EventContext{Day: string(todayKey)}
 			return checkEventsForDay(client, tx.Bucket(b), evCtx)
 		}
@@ -108,7 +124,7 @@ func checkIfEventsStartingSoon(db *bolt.DB) error {
 	})
 }
 
-func checkEventsForDay(client *http.Client, b *bolt.Bucket, evCtx EventContext) error {
+func checkEventsForDay(client bookingClient, b *bolt.Bucket, evCtx EventContext) error {
 	productsAvailable := []ProductId{}
 	if err := json.Unmarshal(b.Get([]byte("products")), &productsAvailable); err != nil {
 		return fmt.Errorf("Can't parse products {%s}: %v", b.Get([]byte("products")), err)
@@ -119,8 +135,13 @@ func checkEventsForDay(client *http.Client, b *bolt.Bucket, evCtx EventContext)
 		return fmt.Errorf("Can't create 'events' bucket: %v", err)
 	}
 
-	// Record which session IDs we've seen, to work out if any have been cancelled
+	evCtx.newEvents = &gcalInsertBatch{}
+
+	// Record which session IDs we've seen, to work out if any have been
+	// cancelled, and which product's page each kind of session is listed
+	// on, for cancelled sessions whose snapshots don't record the product
 	var sessionIdsSeen []string
+	pageProducts := map[string]ProductId{}
 
 	for _, pid := range productsAvailable {
 		evCtx.Product = pid
@@ -132,10 +153,11 @@ func checkEventsForDay(client *http.Client, b *bolt.Bucket, evCtx EventContext)
 		// Add 'em
 		now := time.Now()
 		for _, ev := range *evs {
-			if err := updateEvent(evBucket, evCtx, timestampedEventInfo{ev, now, false}); err != nil {
+			if err := updateEvent(evBucket, evCtx, timestampedEventInfo{ev, now, false, pid}); err != nil {
 				return fmt.Errorf("Can't write event: %v", err)
 			}
 			sessionIdsSeen = append(sessionIdsSeen, ev.SessionId)
+			pageProducts[ev.ProductName] = pid
 		}
 	}
 
@@ -161,13 +183,24 @@ func checkEventsForDay(client *http.Client, b *bolt.Bucket, evCtx EventContext)
 
 				if !isSessionInList(sessionIdsSeen, string(sid)) {
 					// Event not yet started, and missing from list -> cancelled!
-					if err := updateEvent(evBucket, evCtx, timestampedEventInfo{lastEv.EventInfo, now, true}); err != nil {
+					evCtx.Product = lastEv.Product
+					if evCtx.Product == "" {
+						evCtx.Product = pageProducts[lastEv.ProductName]
+					}
+					if evCtx.Product == "" {
+						evCtx.Product = sessionProduct(productsAvailable, lastEv)
+					}
+					if err := updateEvent(evBucket, evCtx, timestampedEventInfo{lastEv.EventInfo, now, true, evCtx.Product}); err != nil {
 						return fmt.Errorf("can't write event: %v", err)
 					}
 				}
 			}
 		}
 	}
+
+	// Only once the day's been checked successfully, as otherwise its
+	// snapshots won't be stored
+	evCtx.newEvents.flush(b.Tx())
 	return nil
 }
 
@@ -180,8 +213,32 @@ func isSessionInList(seen []string, sessId string) bool {
 	return false
 }
 
+// sessionProduct works out which product a stored session belongs to.
+// Older snapshots don't record it, but it can still be inferred if only
+// one product is available on the day.
+func sessionProduct(productsAvailable []ProductId, ev timestampedEventInfo) ProductId {
+	if ev.Product == "" && len(productsAvailable) == 1 {
+		return productsAvailable[0]
+	}
+	return ev.Product
+}
+
 var ErrNoSuchEvent = errors.New("no such event")
 
+// getHistory returns every snapshot of the session, oldest first
+func getHistory(sessionBucket *bolt.Bucket) ([]timestampedEventInfo, error) {
+	var history []timestampedEventInfo
+	err := sessionBucket.ForEach(func(k, evJson []byte) error {
+		ev := timestampedEventInfo{}
+		if err := json.Unmarshal(evJson, &ev); err != nil {
+			return fmt.Errorf("Can't parse event info (%x): %v", k, err)
+		}
+		history = append(history, ev)
+		return nil
+	})
+	return history, err
+}
+
 func getMostRecentDetails(sessionBucket *bolt.Bucket) (timestampedEventInfo, error) {
 	// Find last entry if it exists and deserialise it
 	// compare to current.  If different, append current
@@ -198,6 +255,70 @@ func getMostRecentDetails(sessionBucket *bolt.Bucket) (timestampedEventInfo, err
 	return lastEv, nil
 }
 
+// storedSession is the most recent snapshot of a session, with the context
+// needed to publish it
+type storedSession struct {
+	EventContext
+	Event    timestampedEventInfo
+	Sequence uint64
+}
+
+// latestSessions returns the most recent snapshot of every session on the
+// days between fromDay and toDay inclusive.  An empty toDay has no limit.
+func latestSessions(tx *bolt.Tx, fromDay, toDay string) ([]storedSession, error) {
+	var sessions []storedSession
+
+	c := tx.Cursor()
+	for day, _ := c.Seek([]byte(fromDay)); day != nil; day, _ = c.Next() {
+		if toDay != "" && string(day) > toDay {
+			break
+		}
+		if !isDayKey(day) {
+			continue
+		}
+
+		b := tx.Bucket(day)
+		evs := b.Bucket([]byte("events"))
+		if evs == nil {
+			continue
+		}
+
+		productsAvailable := []ProductId{}
+		json.Unmarshal(b.Get([]byte("products")), &productsAvailable)
+
+		err := evs.ForEach(func(sid, _ []byte) error {
+			sb := evs.Bucket(sid)
+			ev, err := getMostRecentDetails(sb)
+			if err == ErrNoSuchEvent {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			history, err := getHistory(sb)
+			if err != nil {
+				return err
+			}
+
+			sessions = append(sessions, storedSession{
+				EventContext: EventContext{
+					Day:     string(day),
+					Product: sessionProduct(productsAvailable, ev),
+					History: history[:len(history)-1],
+				},
+				Event:    ev,
+				Sequence: sb.Sequence() - 1,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sessions, nil
+}
+
 // update event details by comparing with last poll result (in bucket named
 // by session ID) and adding if different or if this is the first poll of
 // the event
@@ -207,20 +328,26 @@ func updateEvent(eventsBucket *bolt.Bucket, evCtx EventContext, ev timestampedEv
 		return fmt.Errorf("Can't create bucket for session: %v", err)
 	}
 
+	logger := sessionLogger(evCtx.Day, evCtx.Product, ev.SessionId)
+
 	// Find last entry if it exists and deserialise it
 	// compare to current.  If different, append current
+	var previous *timestampedEventInfo
 	if lastEv, err := getMostRecentDetails(b); err == nil {
-		// If all of these fields are the same, no need to write the new event
+		// If all of these fields are the same, no need to write the new
+		// event, though the site may have changed fields we don't use
 		if eventsSimilar(ev, lastEv) {
-			return nil
+			lastKey, _ := b.Cursor().Last()
+			return storeChangedRawPayload(eventsBucket.Tx(), evCtx.Day, ev.SessionId, lastKey, ev.raw, ev.UpdatedAt)
 		}
-		log.Println("Updating event info:", evCtx.Day, ev.StartTime, ev.ProductName, eventDiff(lastEv, ev))
+		logger.Info("Updating event info", eventDiffAttrs(lastEv, ev)...)
+		previous = &lastEv
 	} else {
-		log.Println("Creating event info:", evCtx.Day, ev.EventInfo)
+		logger.Info("Creating event info", "start", ev.StartTime, "end", ev.EndTime,
+			"location", ev.Location, "capacity", ev.TotalSpaces, "free", ev.AvailableSpaces,
+			"academy_capacity", ev.CapacityFreeAcademy, "academy_free", ev.AvailableFreeSpaces)
 	}
 
-	optionallyUpdateCalendar(ev, evCtx)
-
 	evJson, err := json.Marshal(ev)
 	if err != nil {
 		return fmt.Errorf("Can't marshal event info: %v", err)
@@ -231,8 +358,34 @@ func updateEvent(eventsBucket *bolt.Bucket, evCtx EventContext, ev timestampedEv
 	newKey := make([]byte, 8)
 	binary.BigEndian.PutUint64(newKey, uint64(id))
 
+	if evCtx.History, err = getHistory(b); err != nil {
+		return err
+	}
+	optionallyUpdateCalendar(eventsBucket.Tx(), ev, evCtx, id-1)
+
 	// Save this event info
-	return b.Put(newKey, evJson)
+	if err := b.Put(newKey, evJson); err != nil {
+		return err
+	}
+	if err := storeRawPayload(eventsBucket.Tx(), evCtx.Day, ev.SessionId, newKey, ev.raw); err != nil {
+		return err
+	}
+
+	sc := SessionChange{EventContext: evCtx, Previous: previous, Current: ev, Sequence: id}
+	if sc.Cursor, err = recordChange(eventsBucket.Tx(), sc); err != nil {
+		return err
+	}
+
+	// Only announce the change once it's committed, so that streamed
+	// changes can always be found in the changes log
+	eventsBucket.Tx().OnCommit(func() {
+		snapshotsWritten.Inc()
+		if sc.IsCancellation() {
+			cancellationsDetected.Inc()
+		}
+		notifyChange(sc)
+	})
+	return nil
 }
 
 func eventsSimilar(a, b timestampedEventInfo) bool {
@@ -250,6 +403,29 @@ func eventsSimilar(a, b timestampedEventInfo) bool {
 	return false
 }
 
+// eventDiffAttrs gives the changes between the snapshots as log fields,
+// each a group of the old and new values
+func eventDiffAttrs(orig, updated timestampedEventInfo) []any {
+	var attrs []any
+	diff := func(key string, from, to any) {
+		if from != to {
+			attrs = append(attrs, slog.Group(key, "from", from, "to", to))
+		}
+	}
+
+	diff("product_name", orig.ProductName, updated.ProductName)
+	diff("location", orig.Location, updated.Location)
+	diff("start", orig.StartTime, updated.StartTime)
+	diff("end", orig.EndTime, updated.EndTime)
+	diff("capacity", orig.TotalSpaces, updated.TotalSpaces)
+	diff("free", orig.AvailableSpaces, updated.AvailableSpaces)
+	diff("academy_capacity", orig.CapacityFreeAcademy, updated.CapacityFreeAcademy)
+	diff("academy_free", orig.AvailableFreeSpaces, updated.AvailableFreeSpaces)
+	diff("cancelled", orig.Cancelled, updated.Cancelled)
+
+	return attrs
+}
+
 func eventDiff(orig, updated timestampedEventInfo) string {
 	var op []string
 
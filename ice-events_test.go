@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// fakeBookingSite answers requests for session times with the sessions
+// listed for each product
+type fakeBookingSite map[ProductId][]EventInfo
+
+func (fb fakeBookingSite) RoundTrip(req *http.Request) (*http.Response, error) {
+	sessions := fb[ProductId(req.URL.Query().Get("productId"))]
+	if sessions == nil {
+		sessions = []EventInfo{}
+	}
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(string(data))),
+		Request:    req,
+	}, nil
+}
+
+func fakeBookingSession(sid string, spaces int) EventInfo {
+	return EventInfo{SessionId: sid, ProductName: "Public Skating", Location: "Rink 1",
+		StartTime: "18:00:00", EndTime: "19:00:00", TotalSpaces: 100, AvailableSpaces: spaces}
+}
+
+// useProducts replaces the products configuration until the end of the test
+func useProducts(t *testing.T, products map[ProductId]ProductConfig) {
+	saved := productsMap
+	t.Cleanup(func() { productsMap = saved })
+	productsMap = products
+}
+
+// newTestDay opens a database with a day tomorrow, offering the products
+func newTestDay(t *testing.T, products ...ProductId) (*bolt.DB, string) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	day := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	productsJson, _ := json.Marshal(products)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(day))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("products"), productsJson)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return db, day
+}
+
+func checkTestDay(t *testing.T, db *bolt.DB, day string, site fakeBookingSite) {
+	t.Helper()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return checkEventsForDay(bookingClient{Client: &http.Client{Transport: site}}, tx.Bucket([]byte(day)), EventContext{Day: day})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckEventsBatchesNewEvents(t *testing.T) {
+	fg, ga, rt := newFakeServiceAuthenticator(t, 1, false)
+	saved := GCalClient
+	t.Cleanup(func() { GCalClient = saved })
+	GCalClient = &http.Client{Transport: ga}
+
+	const calendarId = "cal@example.com"
+	useProducts(t, map[ProductId]ProductConfig{"prod-a": {GCal: calendarId}})
+	db, day := newTestDay(t, "prod-a")
+
+	// The new sessions' events are inserted together
+	checkTestDay(t, db, day, fakeBookingSite{"prod-a": {fakeBookingSession("1", 50), fakeBookingSession("2", 50)}})
+	if paths := rt.paths(); strings.Join(paths, " ") != "/token /batch/calendar/v3" {
+		t.Errorf("requests made for new sessions %v, want a token and a batch", paths)
+	}
+	if n := len(fg.calendars[calendarId]); n != 2 {
+		t.Errorf("%v events inserted, want 2", n)
+	}
+
+	// Changes to known sessions are still pushed straight away
+	rt.requests = nil
+	checkTestDay(t, db, day, fakeBookingSite{"prod-a": {fakeBookingSession("1", 40), fakeBookingSession("2", 50)}})
+	want := "/calendar/v3/calendars/" + calendarId + "/events/" + sessionEventId("1")
+	if paths := rt.paths(); len(paths) != 1 || paths[0] != want {
+		t.Errorf("requests made for a changed session %v, want an update", paths)
+	}
+}
+
+func TestCheckEventsCancellationProduct(t *testing.T) {
+	useProducts(t, map[ProductId]ProductConfig{})
+	db, day := newTestDay(t, "prod-a", "prod-b")
+
+	// A session stored before products were recorded, which has gone
+	// from the page of the product it was listed under
+	old, _ := json.Marshal(timestampedEventInfo{EventInfo: fakeBookingSession("1", 50), UpdatedAt: time.Now()})
+	if err := db.Update(func(tx *bolt.Tx) error {
+		evs, err := tx.Bucket([]byte(day)).CreateBucketIfNotExists([]byte("events"))
+		if err != nil {
+			return err
+		}
+		sb, err := evs.CreateBucketIfNotExists([]byte("1"))
+		if err != nil {
+			return err
+		}
+		return sb.Put(sequenceKey(1), old)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestDay(t, db, day, fakeBookingSite{"prod-a": {fakeBookingSession("2", 50)}})
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		lastEv, err := getMostRecentDetails(tx.Bucket([]byte(day)).Bucket([]byte("events")).Bucket([]byte("1")))
+		if err != nil {
+			return err
+		}
+		if !lastEv.Cancelled || lastEv.Product != "prod-a" {
+			t.Errorf("session cancelled %v with product %q, want cancelled with prod-a", lastEv.Cancelled, lastEv.Product)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
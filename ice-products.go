@@ -10,7 +10,23 @@ import (
 
 type ProductId string
 
-var productsMap map[ProductId]struct{ GCal string }
+// ProductConfig is the configuration for a product, as read from the
+// products file.  Sessions are synced to any calendars configured here.
+type ProductConfig struct {
+	// GCal is the id of a Google Calendar
+	GCal string
+	// CalDAV is the url of a CalDAV calendar collection
+	CalDAV string
+
+	// Templates optionally override the content of calendar events
+	Templates EventTemplates
+	// ColorId is a Google Calendar event colour, from 1 to 11
+	ColorId string
+	// Reminders override the calendar's default reminders if set
+	Reminders []GCalReminder
+}
+
+var productsMap map[ProductId]ProductConfig
 
 func loadProducts(prodFile string) error {
 	f, err := os.Open(prodFile)
@@ -28,6 +44,13 @@ func loadProducts(prodFile string) error {
 		return errors.Wrap(err, "parsing products file")
 	}
 
+	for pid, prodCfg := range productsMap {
+		if err := prodCfg.Templates.compile(); err != nil {
+			return errors.Wrapf(err, "parsing templates for %v", pid)
+		}
+		productsMap[pid] = prodCfg
+	}
+
 	return nil
 }
 
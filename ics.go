@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// The iCalendar export produces an RFC 5545 VCALENDAR from the most recent
+// snapshot of each session, for those who don't use Google Calendar.
+// https://tools.ietf.org/html/rfc5545
+
+// icsProdId identifies this application as the producer of the calendar
+const icsProdId = "-//mhp//ice-scraper//EN"
+
+// icsUidDomain is appended to the session's event id to form a globally
+// unique, stable UID
+const icsUidDomain = "ice-scraper"
+
+const icsTimeFormat = "20060102T150405Z"
+
+// exportIcsCommand writes a calendar for the product given on the command
+// line (or all products if none is given) to stdout
+func exportIcsCommand(db *bolt.DB, args []string) error {
+	var product ProductId
+	if len(args) > 0 {
+		product = ProductId(args[0])
+		if _, ok := productsMap[product]; !ok {
+			return errors.Errorf("unknown product %v", product)
+		}
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if err := exportIcs(db, w, product); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// exportIcs writes a VCALENDAR containing every stored session from the
+// last icsPastDays onwards for the given product, or for all products if
+// product is empty
+func exportIcs(db *bolt.DB, w io.Writer, product ProductId) error {
+	iw := &icsWriter{w: w}
+
+	iw.line("BEGIN:VCALENDAR")
+	iw.line("VERSION:2.0")
+	iw.line("PRODID:" + icsProdId)
+	iw.line("CALSCALE:GREGORIAN")
+	iw.line("METHOD:PUBLISH")
+	iw.line("X-WR-CALNAME:" + icsEscape(icsCalendarName(product)))
+
+	err := db.View(func(tx *bolt.Tx) error {
+		return forEachIcsDay(tx, func(day []byte, b *bolt.Bucket, evs *bolt.Bucket) error {
+			productsAvailable := []ProductId{}
+			json.Unmarshal(b.Get([]byte("products")), &productsAvailable)
+
+			return evs.ForEach(func(sid, _ []byte) error {
+				k, evJson := evs.Bucket(sid).Cursor().Last()
+				if k == nil {
+					return nil
+				}
+
+				ev := timestampedEventInfo{}
+				if err := json.Unmarshal(evJson, &ev); err != nil {
+					return errors.Wrapf(err, "parsing session %s", sid)
+				}
+
+				evCtx := EventContext{Day: string(day), Product: sessionProduct(productsAvailable, ev)}
+				if product != "" && evCtx.Product != product {
+					return nil
+				}
+
+				// Sequences start from 1, but iCalendar's start from 0
+				return writeVEvent(iw, ev, evCtx, binary.BigEndian.Uint64(k)-1)
+			})
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	iw.line("END:VCALENDAR")
+	return iw.err
+}
+
+// icsPastDays is how many days before today the calendar goes back, so
+// that it doesn't grow forever
+const icsPastDays = 28
+
+// forEachIcsDay calls fn with each day in the calendar which has sessions
+func forEachIcsDay(tx *bolt.Tx, fn func(day []byte, b *bolt.Bucket, evs *bolt.Bucket) error) error {
+	from := time.Now().AddDate(0, 0, -icsPastDays).Format("2006-01-02")
+
+	c := tx.Cursor()
+	for day, _ := c.Seek([]byte(from)); day != nil; day, _ = c.Next() {
+		if !isDayKey(day) {
+			continue
+		}
+		b := tx.Bucket(day)
+		evs := b.Bucket([]byte("events"))
+		if evs == nil {
+			continue
+		}
+		if err := fn(day, b, evs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func icsCalendarName(product ProductId) string {
+	if product == "" {
+		return "Ice sessions"
+	}
+	return fmt.Sprintf("Ice sessions (%v)", product)
+}
+
+// writeVEvent emits a VEVENT for the given session snapshot, reusing the
+// content that would be pushed to Google Calendar
+func writeVEvent(iw *icsWriter, ev timestampedEventInfo, evCtx EventContext, sequence uint64) error {
+	calEv, err := makeGCalEvent(ev, evCtx)
+	if err != nil {
+		return err
+	}
+
+	status := "CONFIRMED"
+	if ev.Cancelled {
+		status = "CANCELLED"
+	}
+
+	iw.line("BEGIN:VEVENT")
+	iw.line(fmt.Sprintf("UID:%v@%v", calEv.Id, icsUidDomain))
+	iw.line(fmt.Sprintf("SEQUENCE:%d", sequence))
+	iw.line("DTSTAMP:" + ev.UpdatedAt.UTC().Format(icsTimeFormat))
+	iw.line("LAST-MODIFIED:" + ev.UpdatedAt.UTC().Format(icsTimeFormat))
+	iw.line("DTSTART:" + calEv.Start.DateTime.UTC().Format(icsTimeFormat))
+	iw.line("DTEND:" + calEv.End.DateTime.UTC().Format(icsTimeFormat))
+	iw.line("SUMMARY:" + icsEscape(calEv.Summary))
+	iw.line("LOCATION:" + icsEscape(calEv.Location))
+	iw.line("DESCRIPTION:" + icsEscape(calEv.Description))
+	if evCtx.Product != "" {
+		iw.line("URL:" + makeProductLink(evCtx.Product))
+	}
+	iw.line("STATUS:" + status)
+	iw.line("END:VEVENT")
+
+	return iw.err
+}
+
+// icsEscape escapes TEXT values as described in RFC 5545 section 3.3.11
+func icsEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// icsWriter writes content lines, folding them at 75 octets and
+// remembering the first error encountered
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+const icsMaxLineLength = 75
+
+func (iw *icsWriter) line(l string) {
+	if iw.err != nil {
+		return
+	}
+
+	var folded strings.Builder
+	width := 0
+	for _, r := range l {
+		size := len(string(r))
+		if width+size > icsMaxLineLength {
+			// Continuation lines start with a space, which counts
+			folded.WriteString("\r\n ")
+			width = 1
+		}
+		folded.WriteRune(r)
+		width += size
+	}
+	folded.WriteString("\r\n")
+
+	_, iw.err = io.WriteString(iw.w, folded.String())
+}
+
+// icsLastModified returns the time of the most recent snapshot in the
+// calendar, for use in http caching headers
+func icsLastModified(db *bolt.DB) (time.Time, error) {
+	var latest time.Time
+	err := db.View(func(tx *bolt.Tx) error {
+		return forEachIcsDay(tx, func(day []byte, b *bolt.Bucket, evs *bolt.Bucket) error {
+			return evs.ForEach(func(sid, _ []byte) error {
+				if ev, err := getMostRecentDetails(evs.Bucket(sid)); err == nil && ev.UpdatedAt.After(latest) {
+					latest = ev.UpdatedAt
+				}
+				return nil
+			})
+		})
+	})
+	return latest, err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// putTestSnapshots stores each snapshot of a session in turn on the day,
+// which offers the product
+func putTestSnapshots(t *testing.T, db *bolt.DB, day string, product ProductId, snapshots ...timestampedEventInfo) {
+	t.Helper()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(day))
+		if err != nil {
+			return err
+		}
+		productsJson, _ := json.Marshal([]ProductId{product})
+		if err := b.Put([]byte("products"), productsJson); err != nil {
+			return err
+		}
+		evs, err := b.CreateBucketIfNotExists([]byte("events"))
+		if err != nil {
+			return err
+		}
+		for _, ev := range snapshots {
+			sb, err := evs.CreateBucketIfNotExists([]byte(ev.SessionId))
+			if err != nil {
+				return err
+			}
+			seq, _ := sb.NextSequence()
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, seq)
+			evJson, _ := json.Marshal(ev)
+			if err := sb.Put(k, evJson); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openTestDb(t *testing.T) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func icsTestSession(sid string, spaces int, updatedAt time.Time) timestampedEventInfo {
+	return timestampedEventInfo{
+		EventInfo: EventInfo{
+			SessionId:       sid,
+			ProductName:     `Public Skating; Disco, with "DJ" \ lights`,
+			Location:        "Rink 1",
+			StartTime:       "18:00:00",
+			EndTime:         "19:30:00",
+			TotalSpaces:     100,
+			AvailableSpaces: spaces,
+		},
+		UpdatedAt: updatedAt,
+	}
+}
+
+const icsGolden = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//mhp//ice-scraper//EN\r\n" +
+	"CALSCALE:GREGORIAN\r\n" +
+	"METHOD:PUBLISH\r\n" +
+	"X-WR-CALNAME:Ice sessions (prod-a)\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:64p36d0@ice-scraper\r\n" +
+	"SEQUENCE:1\r\n" +
+	"DTSTAMP:20990701T110000Z\r\n" +
+	"LAST-MODIFIED:20990701T110000Z\r\n" +
+	"DTSTART:20990702T170000Z\r\n" +
+	"DTEND:20990702T183000Z\r\n" +
+	"SUMMARY:Public Skating\\; Disco\\, with \"DJ\" \\\\ lights\r\n" +
+	"LOCATION:Rink 1\r\n" +
+	"DESCRIPTION:0 Academy\\, 60 other booked\\nhttps://bookings.national-ice-cent\r\n" +
+	" re.com/booking/ice-sports-details!cHJvZC1h\\nLast updated: Jul  1 12:00:00\\\r\n" +
+	" n\r\n" +
+	"URL:https://bookings.national-ice-centre.com/booking/ice-sports-details!cHJ\r\n" +
+	" vZC1h\r\n" +
+	"STATUS:CONFIRMED\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestExportIcsGolden(t *testing.T) {
+	useProducts(t, map[ProductId]ProductConfig{"prod-a": {}})
+	db := openTestDb(t)
+
+	first := time.Date(2099, 6, 30, 9, 0, 0, 0, time.UTC)
+	second := time.Date(2099, 7, 1, 11, 0, 0, 0, time.UTC)
+	putTestSnapshots(t, db, "2099-07-02", "prod-a", icsTestSession("1234", 50, first), icsTestSession("1234", 40, second))
+	// Too long ago to be in the calendar
+	putTestSnapshots(t, db, "2000-01-01", "prod-a", icsTestSession("99", 50, first))
+
+	buf := &bytes.Buffer{}
+	if err := exportIcs(db, buf, "prod-a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != icsGolden {
+		t.Errorf("calendar:\n%v\nwant:\n%v", got, icsGolden)
+	}
+
+	for _, l := range strings.Split(buf.String(), "\r\n") {
+		if len(l) > icsMaxLineLength {
+			t.Errorf("line longer than %v octets: %q", icsMaxLineLength, l)
+		}
+	}
+}
+
+func TestIcsLineFoldingKeepsCharacters(t *testing.T) {
+	// A multi-byte character mustn't be split across lines
+	long := "SUMMARY:" + strings.Repeat("a", 64) + "€€€"
+	buf := &bytes.Buffer{}
+	iw := &icsWriter{w: buf}
+	iw.line(long)
+
+	want := "SUMMARY:" + strings.Repeat("a", 64) + "€\r\n €€\r\n"
+	if buf.String() != want {
+		t.Errorf("folded %q, want %q", buf.String(), want)
+	}
+}
+
+func TestIcsUidStableAndSequenceIncreases(t *testing.T) {
+	useProducts(t, map[ProductId]ProductConfig{"prod-a": {}})
+	db := openTestDb(t)
+
+	updated := time.Date(2099, 7, 1, 11, 0, 0, 0, time.UTC)
+	for i, spaces := range []int{50, 40, 40} {
+		ev := icsTestSession("1234", spaces, updated.Add(time.Duration(i)*time.Hour))
+		ev.Cancelled = i == 2
+		putTestSnapshots(t, db, "2099-07-02", "prod-a", ev)
+
+		buf := &bytes.Buffer{}
+		if err := exportIcs(db, buf, ""); err != nil {
+			t.Fatal(err)
+		}
+		got := buf.String()
+		want := []string{"\r\nUID:64p36d0@ice-scraper\r\n", fmt.Sprintf("\r\nSEQUENCE:%d\r\n", i)}
+		if ev.Cancelled {
+			want = append(want, "\r\nSTATUS:CANCELLED\r\n")
+		}
+		for _, w := range want {
+			if !strings.Contains(got, w) {
+				t.Errorf("snapshot %v: calendar doesn't contain %q:\n%v", i, w, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Logging is structured, through log/slog, so that messages carry fields
+// such as the day, product and session they concern.  Each run of a
+// command gets an id, so that its messages can be picked out of a shared
+// log.
+//
+// The format is logfmt by default, or JSON if --log-format=json is given
+// or ICESCRAPER_LOG_FORMAT is json.  --verbose shows debug messages and
+// --quiet only warnings and errors, as does ICESCRAPER_LOG_LEVEL.
+
+// logLevel can be changed whilst running
+var logLevel = new(slog.LevelVar)
+
+// setupLogging takes the logging options from the front of the command
+// line, returning the arguments that are left, and makes the default
+// logger write in the chosen format
+func setupLogging(args []string) ([]string, error) {
+	format := os.Getenv("ICESCRAPER_LOG_FORMAT")
+	if level := os.Getenv("ICESCRAPER_LOG_LEVEL"); level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("bad log level %q", level)
+		}
+	}
+
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch arg := args[0]; {
+		case arg == "-v" || arg == "--verbose":
+			logLevel.Set(slog.LevelDebug)
+		case arg == "-q" || arg == "--quiet":
+			logLevel.Set(slog.LevelWarn)
+		case strings.HasPrefix(arg, "--log-format="):
+			format = strings.TrimPrefix(arg, "--log-format=")
+		default:
+			return nil, fmt.Errorf("unknown option %v", arg)
+		}
+		args = args[1:]
+	}
+
+	handler, err := newLogHandler(os.Stderr, format)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(slog.New(handler))
+	return args, nil
+}
+
+func newLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Errors from pkg/errors would otherwise be logged with
+			// their stack trace
+			if err, ok := a.Value.Any().(error); ok {
+				a.Value = slog.StringValue(err.Error())
+			}
+			return a
+		},
+	}
+	switch format {
+	case "", "logfmt":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// processRunId identifies this run of a command
+var processRunId = newRunId()
+
+// newRunId returns a short random id for a run of a command
+func newRunId() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// fatal logs an error and exits, like log.Fatal
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// sessionLogger returns a logger for messages about a session
+func sessionLogger(day string, product ProductId, sessionId string) *slog.Logger {
+	return slog.With("day", day, "product", product, "session", sessionId)
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -16,9 +19,33 @@ func setupGcalSync() {
 
 	// We need the authfile but tokenfile is optional
 	if gcalCredFile != "" {
-		ga, err := NewAuthenticator(gcalCredFile, gcalTokenFile)
+		// Several credentials files can be given whilst rotating keys
+		ga, err := NewAuthenticator(filepath.SplitList(gcalCredFile), gcalTokenFile)
 		if err != nil {
-			log.Println("Can't create GCal client - no syncing", err)
+			slog.Error("Can't create GCal client - no syncing", "err", err)
+			return
+		}
+
+		if skew := os.Getenv("ICESCRAPER_GCAL_REFRESH_SKEW"); skew != "" {
+			if d, err := time.ParseDuration(skew); err != nil {
+				slog.Error("Can't parse token refresh skew", "err", err)
+			} else {
+				ga.RefreshSkew = d
+			}
+		}
+
+		// These let us run against a stand-in such as a test server
+		if scopes := os.Getenv("ICESCRAPER_GCAL_SCOPES"); scopes != "" {
+			ga.Scopes = strings.Fields(scopes)
+		}
+		if uri := os.Getenv("ICESCRAPER_GCAL_TOKEN_URI"); uri != "" {
+			ga.SetTokenUri(uri)
+		}
+		if uri := os.Getenv("ICESCRAPER_GCAL_REVOKE_URI"); uri != "" {
+			ga.RevokeUri = uri
+		}
+		if root := os.Getenv("ICESCRAPER_GCAL_API_ROOT"); root != "" {
+			setGcalApiRoot(root)
 		}
 
 		GCalClient = &http.Client{Transport: ga}
@@ -26,52 +53,140 @@ func setupGcalSync() {
 }
 
 const DefaultDbName = "ice-info.db"
+
+// dbOpenTimeout is how long to wait for another process to close the
+// database
+const dbOpenTimeout = 10 * time.Second
 const DefaultProductsName = "products.json"
 
 func main() {
-	if len(os.Args) != 2 {
-		log.Fatalln("Specify argument")
+	args, err := setupLogging(os.Args[1:])
+	if err != nil {
+		fatal("Can't set up logging", "err", err)
 	}
+	if len(args) < 1 {
+		fatal("Specify argument")
+	}
+	command := args[0]
+	slog.SetDefault(slog.With("command", command, "run", processRunId))
 
 	dbName := os.Getenv("ICESCRAPER_DB_FILE")
 	if dbName == "" {
 		dbName = DefaultDbName
 	}
 
-	db, err := bolt.Open(dbName, 0644, nil)
-	if err != nil {
-		log.Fatalln("Can't open database:", err)
+	// The daemon keeps the database locked, so don't wait forever for it
+	db, err := bolt.Open(dbName, 0644, &bolt.Options{Timeout: dbOpenTimeout})
+	if err == bolt.ErrTimeout {
+		fatal("Database is locked - serve runs the checks itself, so they can't run alongside it", "db", dbName)
+	} else if err != nil {
+		fatal("Can't open database", "err", err)
 	}
 	defer db.Close()
 
 	setupGcalSync()
+	if err := checkGcalEditPolicy(); err != nil {
+		fatal("Can't set up calendar sync", "err", err)
+	}
+	setupNotifiers()
 
 	prodFile := os.Getenv("ICESCRAPER_PRODUCTS_FILE")
 	if prodFile == "" {
 		prodFile = DefaultProductsName
 	}
 	if err := loadProducts(prodFile); err != nil {
-		log.Fatalln("Can't load products:", err)
+		fatal("Can't load products", "err", err)
 	}
+	setupCaldavSync()
 
-	switch os.Args[1] {
+	switch command {
 
 	// Run this daily to find what products are on which days
 	case "check-calendar":
-		checkForNewDays(db)
+		cronRun(db, "check-calendar", checkForNewDays)
 
 	// Run this a few times a day to discover events for known
 	// products, and update the booking info
 	case "check-events":
-		checkForEvents(db, false)
+		cronRun(db, "check-events", func(db *bolt.DB) error { return checkForEvents(db, false) })
 
 	// Run this more frequently, doing the same for just today's events
 	case "check-todays-events":
-		checkForEvents(db, true)
+		cronRun(db, "check-todays-events", func(db *bolt.DB) error { return checkForEvents(db, true) })
 
 	// Run this all the time - it only does work if an event is about to start
 	case "check-if-events-starting-soon":
-		checkIfEventsStartingSoon(db)
+		cronRun(db, "check-if-events-starting-soon", checkIfEventsStartingSoon)
+
+	// Run this daily to mail out a summary of the coming days
+	case "send-digest":
+		cronRun(db, "send-digest", sendDigest)
+
+	// Run this every so often to retry failed calendar updates
+	case "drain-outbox":
+		cronRun(db, "drain-outbox", drainOutbox)
+
+	// Run this every so often to spot events edited by hand
+	case "gcal-sync":
+		if err := cronRun(db, "gcal-sync", syncCalendars); err != nil {
+			fatal("Can't sync calendars", "err", err)
+		}
+
+	// Run this once to authorise access to a user's calendars
+	case "gcal-authorize":
+		if err := authorizeCommand(); err != nil {
+			fatal("Can't authorise", "err", err)
+		}
+
+	// Revoke and remove the stored Google token
+	case "gcal-revoke":
+		if err := revokeCommand(); err != nil {
+			fatal("Can't revoke token", "err", err)
+		}
+
+	// Bring Google Calendars into line with the database
+	case "gcal-reconcile":
+		if err := cronRun(db, "gcal-reconcile", func(db *bolt.DB) error { return reconcileCalendarsCommand(db, args[1:]) }); err != nil {
+			fatal("Can't reconcile calendars", "err", err)
+		}
+
+	// Push every session to Google Calendar, e.g. after adding a calendar
+	case "gcal-backfill":
+		if err := cronRun(db, "gcal-backfill", func(db *bolt.DB) error { return backfillCalendarsCommand(db, args[1:]) }); err != nil {
+			fatal("Can't backfill calendars", "err", err)
+		}
+
+	// Remove our events from a calendar, e.g. after changing products
+	case "gcal-purge":
+		if err := cronRun(db, "gcal-purge", func(*bolt.DB) error { return purgeCalendarCommand(args[1:]) }); err != nil {
+			fatal("Can't purge calendar", "err", err)
+		}
+
+	// Let pushes overwrite CalDAV objects changed by someone else, either
+	// those given or all of them
+	case "caldav-resolve":
+		if err := resolveCaldavConflicts(db, args[1:]); err != nil {
+			fatal("Can't resolve CalDAV conflicts", "err", err)
+		}
+
+	// Write an iCalendar feed for one product (or all) to stdout
+	case "export-ics":
+		if err := exportIcsCommand(db, args[1:]); err != nil {
+			fatal("Can't export calendar", "err", err)
+		}
+
+	// Run as a daemon, serving calendar feeds and a JSON API, and running
+	// the checks above
+	case "serve":
+		if err := serve(db); err != nil {
+			fatal("Can't serve", "err", err)
+		}
+
+	// Check the checks have been succeeding, for monitoring
+	case "health":
+		if err := healthCommand(db); err != nil {
+			fatal("Health check failed", "err", err)
+		}
 
 	// Debugging / help commands
 	case "summary": // From today onwards
@@ -80,9 +195,11 @@ func main() {
 		showSummary(db, true, true)
 	case "full-summary": // Whole database
 		showSummary(db, false, false)
+	case "show-outbox": // Failed calendar updates waiting to be retried
+		showOutbox(db, os.Stdout)
 	case "dump-db":
 		dumpDb(db)
 	default:
-		log.Fatalln("no such command:", os.Args[1])
+		fatal("No such command")
 	}
 }
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Metrics are kept in memory and written in the Prometheus text format,
+// served on /metrics by the daemon, or written for the node exporter's
+// textfile collector after each command run from cron.  See:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+var (
+	httpRequests = newCounter("icescraper_http_requests_total",
+		"Requests made to upstream services, by endpoint and status code.", "endpoint", "code")
+	httpRequestDuration = newHistogram("icescraper_http_request_duration_seconds",
+		"Time taken by requests to upstream services, by endpoint.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "endpoint")
+
+	daysTracked     = newGauge("icescraper_days_tracked", "Days with ice in the database.")
+	sessionsTracked = newGauge("icescraper_sessions_tracked", "Sessions in the database.")
+
+	// The latest snapshot of each session yet to start
+	sessionAvailable = newGauge("icescraper_session_available_spaces",
+		"Spaces available on a session.", sessionLabels...)
+	sessionAcademyFree = newGauge("icescraper_session_academy_free_spaces",
+		"Free spaces for Academy members available on a session.", sessionLabels...)
+	sessionTotal = newGauge("icescraper_session_total_spaces",
+		"Capacity of a session.", sessionLabels...)
+	sessionCancelled = newGauge("icescraper_session_cancelled",
+		"Whether a session has been cancelled.", sessionLabels...)
+
+	snapshotsWritten = newCounter("icescraper_snapshots_written_total",
+		"Session snapshots written to the database.")
+	cancellationsDetected = newCounter("icescraper_cancellations_total",
+		"Sessions found to have been cancelled.")
+	calendarPushFailures = newCounter("icescraper_calendar_push_failures_total",
+		"Failed pushes of sessions to calendars, by kind of calendar.", "kind")
+	schemaChanges = newCounter("icescraper_schema_changes_total",
+		"Changes seen in the shape of the booking site's responses, by endpoint.", "endpoint")
+	schemaBroken = newGauge("icescraper_schema_broken_fields",
+		"Fields missing from or of the wrong type in the booking site's responses, by endpoint.", "endpoint")
+	tokenRefreshes = newCounter("icescraper_token_refreshes_total",
+		"Google access tokens requested, by result.", "result")
+
+	runs = newCounter("icescraper_runs_total",
+		"Runs of each command, by result.", "command", "result")
+	lastRun = newGauge("icescraper_last_run_timestamp_seconds",
+		"When each command last finished.", "command")
+	lastSuccess = newGauge("icescraper_last_success_timestamp_seconds",
+		"When each command last succeeded.", "command")
+)
+
+var sessionLabels = []string{"day", "start", "product", "location"}
+
+// dbMetrics are derived from the database by updateDbMetrics, rather than
+// counted by the process
+var dbMetrics = map[*metric]bool{
+	daysTracked: true, sessionsTracked: true,
+	sessionAvailable: true, sessionAcademyFree: true, sessionTotal: true, sessionCancelled: true,
+	schemaBroken: true,
+}
+
+// metric is a family of counters, gauges or histograms, one for each
+// combination of label values
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+
+	// Histograms count the observations in each bucket, and in total
+	bucketCounts []uint64
+	count        uint64
+}
+
+// allMetrics holds every metric, in the order they're written
+var allMetrics []*metric
+
+func newMetric(name, help, kind string, buckets []float64, labels []string) *metric {
+	m := &metric{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: map[string]*metricSeries{}}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric(name, help, "counter", nil, labels)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return newMetric(name, help, "gauge", nil, labels)
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return newMetric(name, help, "histogram", buckets, labels)
+}
+
+// get returns the series for the label values, which must be called with
+// the mutex held
+func (m *metric) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %v needs labels %v", m.name, m.labels))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s := m.series[key]
+	if s == nil {
+		s = &metricSeries{labelValues: labelValues, bucketCounts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+func (m *metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *metric) Set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = v
+}
+
+// Reset removes every series, so that ones which are no longer set don't
+// linger
+func (m *metric) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series = map[string]*metricSeries{}
+}
+
+// Total sums the values of every series
+func (m *metric) Total() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total float64
+	for _, s := range m.series {
+		total += s.value
+	}
+	return total
+}
+
+// Observe records a value in a histogram, where value holds the sum
+func (m *metric) Observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.get(labelValues)
+	for i, le := range m.buckets {
+		if v <= le {
+			s.bucketCounts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// write writes the metric in the text format, with the series sorted so
+// that the output is stable.  If command is set, it's added as a label to
+// series which don't already have one, so that the files written by each
+// command don't clash.
+func (m *metric) write(w io.Writer, command string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.series) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP %v %v\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", m.name, m.kind)
+
+	names := m.labels
+	var extra []string
+	if command != "" && !hasLabel(m.labels, "command") {
+		names = append([]string{"command"}, m.labels...)
+		extra = []string{command}
+	}
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		values := append(append([]string(nil), extra...), s.labelValues...)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%v%v %v\n", m.name, formatLabels(names, values), formatFloat(s.value))
+			continue
+		}
+
+		leNames := append(append([]string(nil), names...), "le")
+		leValues := append(append([]string(nil), values...), "")
+		for i, le := range m.buckets {
+			leValues[len(leValues)-1] = formatFloat(le)
+			fmt.Fprintf(w, "%v_bucket%v %v\n", m.name, formatLabels(leNames, leValues), s.bucketCounts[i])
+		}
+		leValues[len(leValues)-1] = "+Inf"
+		fmt.Fprintf(w, "%v_bucket%v %v\n", m.name, formatLabels(leNames, leValues), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", m.name, formatLabels(names, values), formatFloat(s.value))
+		fmt.Fprintf(w, "%v_count%v %v\n", m.name, formatLabels(names, values), s.count)
+	}
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for i, name := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, name, v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeMetrics writes each of the metrics chosen by include, labelled with
+// the command if it's set
+func writeMetrics(w io.Writer, command string, include func(m *metric) bool) {
+	for _, m := range allMetrics {
+		if include(m) {
+			m.write(w, command)
+		}
+	}
+}
+
+// updateDbMetrics sets the gauges which are derived from the database
+func updateDbMetrics(db *bolt.DB) error {
+	return db.View(func(tx *bolt.Tx) error {
+		var days, sessions int
+		err := tx.ForEach(func(day []byte, b *bolt.Bucket) error {
+			if !isDayKey(day) {
+				return nil
+			}
+			days++
+			if evs := b.Bucket([]byte("events")); evs != nil {
+				sessions += evs.Stats().BucketN - 1
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		daysTracked.Set(float64(days))
+		sessionsTracked.Set(float64(sessions))
+
+		states, err := schemaStates(tx)
+		if err != nil {
+			return err
+		}
+		for endpoint, state := range states {
+			schemaBroken.Set(float64(len(state.Report.Missing)+len(state.Report.Mismatched)), endpoint)
+		}
+
+		return updateSessionMetrics(tx)
+	})
+}
+
+// updateSessionMetrics sets the gauges for each session yet to start.
+// Sessions drop out once they've started, which keeps the number of series
+// down.
+func updateSessionMetrics(tx *bolt.Tx) error {
+	now := time.Now()
+	todayKey := fmt.Sprintf("%04d-%02d-%02d", now.Year(), now.Month(), now.Day())
+
+	latest, err := latestSessions(tx, todayKey, "")
+	if err != nil {
+		return err
+	}
+
+	for _, m := range []*metric{sessionAvailable, sessionAcademyFree, sessionTotal, sessionCancelled} {
+		m.Reset()
+	}
+
+	for _, s := range latest {
+		start, err := parseTimeLocally(s.Day, s.Event.StartTime)
+		if err != nil {
+			return err
+		}
+		if start.Before(now) {
+			continue
+		}
+
+		labels := []string{s.Day, s.Event.StartTime, string(s.Product), s.Event.Location}
+		sessionAvailable.Set(float64(s.Event.AvailableSpaces), labels...)
+		sessionAcademyFree.Set(float64(s.Event.AvailableFreeSpaces), labels...)
+		sessionTotal.Set(float64(s.Event.TotalSpaces), labels...)
+
+		cancelled := 0.0
+		if s.Event.Cancelled {
+			cancelled = 1
+		}
+		sessionCancelled.Set(cancelled, labels...)
+	}
+	return nil
+}
+
+// metricsHandler serves the metrics to Prometheus
+func metricsHandler(db *bolt.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := updateDbMetrics(db); err != nil {
+			slog.Error("Can't update database metrics", "err", err)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, "", func(*metric) bool { return true })
+	}
+}
+
+// recordRun records the outcome of a run of a command
+func recordRun(command string, err error) {
+	now := float64(time.Now().Unix())
+	lastRun.Set(now, command)
+	if err != nil {
+		runs.Inc(command, "failure")
+		return
+	}
+	runs.Inc(command, "success")
+	lastSuccess.Set(now, command)
+}
+
+// cronRun runs a command from cron, recording the run, and writes the
+// metrics for the textfile collector if ICESCRAPER_METRICS_TEXTFILE_DIR
+// is set.  Each command's metrics go in a file of their own, labelled with
+// the command, except for the time of the last success, which is left
+// alone when the command fails.  The metrics derived from the database are
+// shared by all the commands, so go in one file.
+//
+// Each run is a process of its own, so the counters are kept in the
+// database between runs, carrying on from where the last run left off.
+func cronRun(db *bolt.DB, command string, run func(db *bolt.DB) error) error {
+	dir := os.Getenv("ICESCRAPER_METRICS_TEXTFILE_DIR")
+	if dir == "" {
+		return trackRun(db, command, processRunId, run)
+	}
+
+	if loadErr := db.View(func(tx *bolt.Tx) error { return loadCounters(tx, command) }); loadErr != nil {
+		slog.Error("Can't load metrics", "err", loadErr)
+	}
+
+	err := trackRun(db, command, processRunId, run)
+
+	if saveErr := db.Update(func(tx *bolt.Tx) error { return saveCounters(tx, command) }); saveErr != nil {
+		slog.Error("Can't save metrics", "err", saveErr)
+	}
+
+	if writeErr := writeMetricsFile(filepath.Join(dir, "ice-scraper-"+command+".prom"), command,
+		func(m *metric) bool { return m != lastSuccess && !dbMetrics[m] }); writeErr != nil {
+		slog.Error("Can't write metrics", "err", writeErr)
+	}
+
+	if err == nil {
+		if writeErr := writeMetricsFile(filepath.Join(dir, "ice-scraper-"+command+"-success.prom"), command,
+			func(m *metric) bool { return m == lastSuccess }); writeErr != nil {
+			slog.Error("Can't write metrics", "err", writeErr)
+		}
+	}
+
+	if dbErr := updateDbMetrics(db); dbErr != nil {
+		slog.Error("Can't update database metrics", "err", dbErr)
+	} else if writeErr := writeMetricsFile(filepath.Join(dir, "ice-scraper-db.prom"), "",
+		func(m *metric) bool { return dbMetrics[m] }); writeErr != nil {
+		slog.Error("Can't write metrics", "err", writeErr)
+	}
+
+	return err
+}
+
+var metricsBucket = []byte("metrics")
+
+// savedSeries is a counter or histogram series, as kept between runs
+type savedSeries struct {
+	LabelValues  []string
+	Value        float64
+	BucketCounts []uint64 `json:",omitempty"`
+	Count        uint64   `json:",omitempty"`
+}
+
+// persistent reports whether a metric is kept between runs from cron
+func (m *metric) persistent() bool {
+	return (m.kind == "counter" || m.kind == "histogram") && !dbMetrics[m]
+}
+
+// loadCounters adds the values the command's counters had at the end of
+// its last run
+func loadCounters(tx *bolt.Tx, command string) error {
+	b := tx.Bucket(metricsBucket)
+	if b == nil {
+		return nil
+	}
+	cb := b.Bucket([]byte(command))
+	if cb == nil {
+		return nil
+	}
+
+	for _, m := range allMetrics {
+		seriesJson := cb.Get([]byte(m.name))
+		if seriesJson == nil || !m.persistent() {
+			continue
+		}
+		var saved []savedSeries
+		if err := json.Unmarshal(seriesJson, &saved); err != nil {
+			return errors.Wrapf(err, "parsing saved %v", m.name)
+		}
+
+		m.mu.Lock()
+		for _, ss := range saved {
+			// Skip series whose labels or buckets have since changed
+			if len(ss.LabelValues) != len(m.labels) || len(ss.BucketCounts) != len(m.buckets) {
+				continue
+			}
+			s := m.get(ss.LabelValues)
+			s.value += ss.Value
+			s.count += ss.Count
+			for i, n := range ss.BucketCounts {
+				s.bucketCounts[i] += n
+			}
+		}
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// saveCounters keeps the command's counters for its next run
+func saveCounters(tx *bolt.Tx, command string) error {
+	b, err := tx.CreateBucketIfNotExists(metricsBucket)
+	if err != nil {
+		return errors.Wrap(err, "creating metrics bucket")
+	}
+	cb, err := b.CreateBucketIfNotExists([]byte(command))
+	if err != nil {
+		return errors.Wrapf(err, "creating metrics bucket for %v", command)
+	}
+
+	for _, m := range allMetrics {
+		if !m.persistent() {
+			continue
+		}
+
+		m.mu.Lock()
+		var saved []savedSeries
+		for _, s := range m.series {
+			ss := savedSeries{LabelValues: s.labelValues, Value: s.value, Count: s.count}
+			if len(m.buckets) > 0 {
+				ss.BucketCounts = s.bucketCounts
+			}
+			saved = append(saved, ss)
+		}
+		m.mu.Unlock()
+
+		seriesJson, err := json.Marshal(saved)
+		if err != nil {
+			return errors.Wrapf(err, "marshalling %v", m.name)
+		}
+		if err := cb.Put([]byte(m.name), seriesJson); err != nil {
+			return errors.Wrapf(err, "saving %v", m.name)
+		}
+	}
+	return nil
+}
+
+// writeMetricsFile writes the metrics atomically, so that the collector
+// never sees a partial file
+func writeMetricsFile(file, command string, include func(m *metric) bool) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return errors.Wrap(err, "creating metrics file")
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	writeMetrics(w, command, include)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing metrics file")
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return errors.Wrap(err, "setting metrics file permissions")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "closing metrics file")
+	}
+
+	return errors.Wrap(os.Rename(f.Name(), file), "replacing metrics file")
+}
+
+// metricsTransport counts and times requests, labelling them with the
+// endpoint if given, or one worked out from the url
+type metricsTransport struct {
+	endpoint string
+	next     http.RoundTripper
+}
+
+func (mt metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := mt.endpoint
+	if endpoint == "" {
+		endpoint = metricsEndpoint(req)
+	}
+
+	start := time.Now()
+	resp, err := mt.next.RoundTrip(req)
+	httpRequestDuration.Observe(time.Since(start).Seconds(), endpoint)
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	httpRequests.Inc(endpoint, code)
+
+	return resp, err
+}
+
+// metricsEndpoint names the endpoint a request is for, keeping the number
+// of different names small
+func metricsEndpoint(req *http.Request) string {
+	p := req.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/booking/"):
+		// ice-sports-calendar or ice-sports-times
+		return path.Base(p)
+	case strings.HasPrefix(p, "/batch"+gcalBatchPath):
+		return "google-calendar-batch"
+	case strings.HasPrefix(p, gcalBatchPath):
+		return "google-calendar"
+	case strings.HasSuffix(p, "/token"):
+		return "google-token"
+	case strings.HasSuffix(p, "/revoke"):
+		return "google-revoke"
+	default:
+		return req.URL.Host
+	}
+}
+
+// instrumentedClient returns a client which records metrics
+func instrumentedClient() *http.Client {
+	return &http.Client{Transport: metricsTransport{next: http.DefaultTransport}}
+}
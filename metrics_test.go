@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// resetMetrics forgets every series, as if in a new process
+func resetMetrics() {
+	for _, m := range allMetrics {
+		m.Reset()
+	}
+}
+
+func TestCronRunCountersCarryOn(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("ICESCRAPER_METRICS_TEXTFILE_DIR", dir)
+
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for run := 1; run <= 2; run++ {
+		resetMetrics()
+		if err := cronRun(db, "test-command", func(*bolt.DB) error {
+			httpRequests.Inc("booking", "200")
+			httpRequestDuration.Observe(0.2, "booking")
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resetMetrics()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "ice-scraper-test-command.prom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`icescraper_http_requests_total{command="test-command",endpoint="booking",code="200"} 2`,
+		`icescraper_http_request_duration_seconds_bucket{command="test-command",endpoint="booking",le="0.25"} 2`,
+		`icescraper_http_request_duration_seconds_count{command="test-command",endpoint="booking"} 2`,
+		`icescraper_runs_total{command="test-command",result="success"} 2`,
+	} {
+		if !strings.Contains(string(data), want+"\n") {
+			t.Errorf("metrics file doesn't have %v:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ChatNotifier posts session changes and digests to an incoming webhook,
+// formatted for either Slack (Block Kit) or Matrix (hookshot-style generic
+// webhooks, which accept plain text and html bodies).
+// Only cancellations and freed spaces are posted, as every booking would
+// otherwise produce a message.  New sessions are left to the digest, as a
+// day's sessions are usually all found at once.
+type ChatNotifier struct {
+	url    string
+	format chatFormat
+	client *http.Client
+}
+
+type chatFormat int
+
+// chatWebhookTimeout limits how long a post can hold up a run
+const chatWebhookTimeout = 30 * time.Second
+
+const (
+	slackFormat chatFormat = iota
+	matrixFormat
+)
+
+// newChatNotifiersFromEnv returns a notifier for each webhook url configured
+func newChatNotifiersFromEnv() []*ChatNotifier {
+	var cns []*ChatNotifier
+
+	if url := os.Getenv("ICESCRAPER_SLACK_WEBHOOK_URL"); url != "" {
+		cns = append(cns, &ChatNotifier{url, slackFormat, &http.Client{Timeout: chatWebhookTimeout}})
+	}
+	if url := os.Getenv("ICESCRAPER_MATRIX_WEBHOOK_URL"); url != "" {
+		cns = append(cns, &ChatNotifier{url, matrixFormat, &http.Client{Timeout: chatWebhookTimeout}})
+	}
+
+	return cns
+}
+
+// chatLine is a single formatted line of a chat message.  Text is marked
+// up as the chat service requires; Link is an optional booking link.
+type chatLine struct {
+	Text string
+	Link string
+}
+
+func (cn *ChatNotifier) NotifyChange(sc SessionChange) error {
+	var what string
+	switch {
+	case sc.IsCancellation():
+		what = "Session cancelled"
+	case sc.SpacesFreed():
+		what = "Spaces available"
+	default:
+		return nil
+	}
+
+	ev := sc.Current
+	title := fmt.Sprintf("%v: %v", what, ev.ProductName)
+	line := chatLine{
+		Text: cn.describeSession(sc.Day, summariseEvent(ev.EventInfo), ev.Cancelled),
+		Link: makeProductLink(sc.Product),
+	}
+
+	return cn.post(title, []chatLine{line})
+}
+
+func (cn *ChatNotifier) NotifyDigest(days []DaySummary) error {
+	title := fmt.Sprintf("Ice sessions from %v", time.Now().Format("Mon 2 Jan"))
+
+	var lines []chatLine
+	for _, d := range days {
+		for _, s := range d.Sessions {
+			line := chatLine{Text: cn.describeSession(d.Day, s, s.Cancelled)}
+			if s.Product != "" {
+				line.Link = makeProductLink(s.Product)
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, chatLine{Text: "No sessions found."})
+	}
+
+	return cn.post(title, lines)
+}
+
+// describeSession formats the key details of a session for a chat message
+func (cn *ChatNotifier) describeSession(day string, s summary, cancelled bool) string {
+	when := fmt.Sprintf("%v %v-%v", day, s.StartTime, s.EndTime)
+	details := fmt.Sprintf("%v, %v: %v Academy, %v other booked", s.Type, s.Location, s.Academy, s.Other)
+
+	switch cn.format {
+	case slackFormat:
+		desc := fmt.Sprintf("*%v* %v", slackEscape(when), slackEscape(details))
+		if cancelled {
+			desc = "~" + desc + "~"
+		}
+		return desc
+	default:
+		desc := fmt.Sprintf("<b>%v</b> %v", html.EscapeString(when), html.EscapeString(details))
+		if cancelled {
+			desc = "<del>" + desc + "</del>"
+		}
+		return desc
+	}
+}
+
+// slackEscape escapes the characters that Slack treats as control sequences
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func (cn *ChatNotifier) post(title string, lines []chatLine) error {
+	var msg interface{}
+	switch cn.format {
+	case slackFormat:
+		msg = slackMessage(title, lines)
+	default:
+		msg = matrixMessage(title, lines)
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshalling chat message")
+	}
+
+	resp, err := cn.client.Post(cn.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "posting chat message")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("chat webhook failed: %v %s", resp.Status, body)
+	}
+
+	return nil
+}
+
+// slackBlocksLimit is the maximum number of blocks in a single Slack message
+const slackBlocksLimit = 50
+
+// slackMessage builds a Block Kit message.  See:
+// https://api.slack.com/reference/block-kit/blocks
+func slackMessage(title string, lines []chatLine) interface{} {
+	type text struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	type block struct {
+		Type string `json:"type"`
+		Text *text  `json:"text,omitempty"`
+	}
+
+	blocks := []block{{Type: "header", Text: &text{"plain_text", title}}}
+	for i, l := range lines {
+		// Keep the last block to say how many didn't fit
+		if len(blocks) == slackBlocksLimit-1 && i < len(lines)-1 {
+			more := fmt.Sprintf("…and %v more", len(lines)-i)
+			blocks = append(blocks, block{Type: "section", Text: &text{"mrkdwn", more}})
+			break
+		}
+		t := l.Text
+		if l.Link != "" {
+			t += fmt.Sprintf(" <%v|Book>", l.Link)
+		}
+		blocks = append(blocks, block{Type: "section", Text: &text{"mrkdwn", t}})
+	}
+
+	return struct {
+		Text   string  `json:"text"`
+		Blocks []block `json:"blocks"`
+	}{title, blocks}
+}
+
+// matrixMessage builds a message with plain text and html versions of the
+// content, as used by Matrix's m.text messages and generic webhook bridges
+func matrixMessage(title string, lines []chatLine) interface{} {
+	plain := []string{title}
+	rich := []string{fmt.Sprintf("<h4>%v</h4>", html.EscapeString(title))}
+
+	for _, l := range lines {
+		// Strip our markup for the plain text version
+		p := strings.NewReplacer("<b>", "", "</b>", "", "<del>", "(cancelled) ", "</del>", "").Replace(l.Text)
+		p = html.UnescapeString(p)
+		h := l.Text
+		if l.Link != "" {
+			p += " " + l.Link
+			h += fmt.Sprintf(` <a href="%v">Book</a>`, html.EscapeString(l.Link))
+		}
+		plain = append(plain, p)
+		rich = append(rich, h)
+	}
+
+	return struct {
+		Text     string `json:"text"`
+		Html     string `json:"html"`
+		MsgType  string `json:"msgtype"`
+		Body     string `json:"body"`
+		Format   string `json:"format"`
+		FmtdBody string `json:"formatted_body"`
+	}{
+		Text:     strings.Join(plain, "\n"),
+		Html:     strings.Join(rich, "<br>"),
+		MsgType:  "m.text",
+		Body:     strings.Join(plain, "\n"),
+		Format:   "org.matrix.custom.html",
+		FmtdBody: strings.Join(rich, "<br>"),
+	}
+}
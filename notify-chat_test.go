@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSlackMessageBlockLimit(t *testing.T) {
+	for _, n := range []int{slackBlocksLimit - 1, slackBlocksLimit, 100} {
+		var lines []chatLine
+		for i := 0; i < n; i++ {
+			lines = append(lines, chatLine{Text: fmt.Sprintf("Session %v", i)})
+		}
+
+		data, err := json.Marshal(slackMessage("Sessions", lines))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg struct {
+			Blocks []struct{ Text struct{ Text string } }
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(msg.Blocks) > slackBlocksLimit {
+			t.Errorf("%v sessions gave %v blocks", n, len(msg.Blocks))
+		}
+		last := msg.Blocks[len(msg.Blocks)-1].Text.Text
+		if n < slackBlocksLimit {
+			if len(msg.Blocks) != n+1 || last != fmt.Sprintf("Session %v", n-1) {
+				t.Errorf("%v sessions gave %v blocks ending %q", n, len(msg.Blocks), last)
+			}
+		} else if want := fmt.Sprintf("…and %v more", n-slackBlocksLimit+2); !strings.Contains(last, want) {
+			t.Errorf("%v sessions ended with %q, want %q", n, last, want)
+		}
+	}
+}
+
+func TestChatNotifyChangeFilters(t *testing.T) {
+	var posts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&msg)
+		posts = append(posts, strings.SplitN(msg.Text, "\n", 2)[0])
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("ICESCRAPER_SLACK_WEBHOOK_URL", "")
+	t.Setenv("ICESCRAPER_MATRIX_WEBHOOK_URL", srv.URL)
+	cns := newChatNotifiersFromEnv()
+	if len(cns) != 1 || cns[0].client.Timeout == 0 {
+		t.Fatalf("notifiers %+v, want one with a timeout", cns)
+	}
+
+	ev, evCtx := testSession(40)
+	freed, _ := testSession(45)
+	cancelled := freed
+	cancelled.Cancelled = true
+	for _, sc := range []SessionChange{
+		{EventContext: evCtx, Current: ev},
+		{EventContext: evCtx, Previous: &ev, Current: freed},
+		{EventContext: evCtx, Previous: &freed, Current: ev},
+		{EventContext: evCtx, Previous: &freed, Current: cancelled},
+	} {
+		if err := cns[0].NotifyChange(sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"Spaces available: Public Skating", "Session cancelled: Public Skating"}
+	if fmt.Sprint(posts) != fmt.Sprint(want) {
+		t.Errorf("posted %q, want %q", posts, want)
+	}
+}
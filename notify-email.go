@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EmailNotifier sends immediate alerts and digests over plain SMTP.
+// Immediate alerts are only sent for cancellations and freed spaces,
+// as other changes are too frequent to be worth a mail.
+type EmailNotifier struct {
+	host     string
+	port     string
+	startTLS bool
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+const DefaultSmtpPort = "587"
+
+// newEmailNotifierFromEnv returns a notifier configured from the environment,
+// or nil if no SMTP host has been set
+func newEmailNotifierFromEnv() *EmailNotifier {
+	host := os.Getenv("ICESCRAPER_SMTP_HOST")
+	if host == "" {
+		return nil
+	}
+
+	en := &EmailNotifier{
+		host:     host,
+		port:     os.Getenv("ICESCRAPER_SMTP_PORT"),
+		startTLS: os.Getenv("ICESCRAPER_SMTP_STARTTLS") != "false",
+		username: os.Getenv("ICESCRAPER_SMTP_USER"),
+		password: os.Getenv("ICESCRAPER_SMTP_PASSWORD"),
+		from:     os.Getenv("ICESCRAPER_SMTP_FROM"),
+	}
+	if en.port == "" {
+		en.port = DefaultSmtpPort
+	}
+	for _, addr := range strings.Split(os.Getenv("ICESCRAPER_SMTP_TO"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			en.to = append(en.to, addr)
+		}
+	}
+
+	return en
+}
+
+func (en *EmailNotifier) NotifyChange(sc SessionChange) error {
+	var what string
+	switch {
+	case sc.IsCancellation():
+		what = "Session cancelled"
+	case sc.SpacesFreed():
+		what = "Spaces available"
+	default:
+		return nil
+	}
+
+	ev := sc.Current
+	s := summariseEvent(ev.EventInfo)
+	subject := fmt.Sprintf("%v: %v %v %v", what, ev.ProductName, sc.Day, ev.StartTime)
+
+	body := &bytes.Buffer{}
+	fmt.Fprintf(body, "%v\n\n", subject)
+	fmt.Fprintf(body, "Session: %v %v-%v, %v\n", sc.Day, ev.StartTime, ev.EndTime, ev.Location)
+	fmt.Fprintf(body, "Booked: %v Academy, %v other\n", s.Academy, s.Other)
+	fmt.Fprintf(body, "Free: %v of %v spaces, %v of %v Academy spaces\n",
+		ev.AvailableSpaces, ev.TotalSpaces, ev.AvailableFreeSpaces, ev.CapacityFreeAcademy)
+	if sc.Previous != nil && !ev.Cancelled {
+		fmt.Fprintf(body, "Changes: %v\n", eventDiff(*sc.Previous, ev))
+	}
+	fmt.Fprintf(body, "\nBook: %v\n", makeProductLink(sc.Product))
+
+	return en.send(subject, body.String())
+}
+
+func (en *EmailNotifier) NotifyDigest(days []DaySummary) error {
+	body := &bytes.Buffer{}
+	w := tabwriter.NewWriter(body, 0, 0, 1, ' ', 0)
+	fmt.Fprint(w, summaryHeader)
+	for _, d := range days {
+		writeSummaries(w, d.Day, d.Sessions)
+	}
+	w.Flush()
+
+	if len(days) == 0 {
+		fmt.Fprintln(body, "No sessions found.")
+	}
+
+	subject := fmt.Sprintf("Ice sessions from %v", time.Now().Format("Mon 2 Jan"))
+	return en.send(subject, body.String())
+}
+
+// smtpTimeout limits how long sending a mail can hold up a run
+var smtpTimeout = 30 * time.Second
+
+// send delivers a plain text mail to all recipients
+func (en *EmailNotifier) send(subject, body string) error {
+	if len(en.to) == 0 {
+		return errors.New("no email recipients configured")
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(en.host, en.port), smtpTimeout)
+	if err != nil {
+		return errors.Wrap(err, "connecting to smtp server")
+	}
+	// The deadline covers the whole conversation, including STARTTLS
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, en.host)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "connecting to smtp server")
+	}
+	defer c.Close()
+
+	if en.startTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: en.host}); err != nil {
+			return errors.Wrap(err, "starting tls")
+		}
+	}
+
+	if en.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", en.username, en.password, en.host)); err != nil {
+			return errors.Wrap(err, "authenticating")
+		}
+	}
+
+	if err := c.Mail(en.from); err != nil {
+		return errors.Wrap(err, "setting sender")
+	}
+	for _, addr := range en.to {
+		if err := c.Rcpt(addr); err != nil {
+			return errors.Wrapf(err, "adding recipient %v", addr)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return errors.Wrap(err, "starting message")
+	}
+
+	fmt.Fprintf(w, "From: %v\r\n", en.from)
+	fmt.Fprintf(w, "To: %v\r\n", strings.Join(en.to, ", "))
+	fmt.Fprintf(w, "Subject: %v\r\n", subject)
+	fmt.Fprintf(w, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	if _, err := w.Write([]byte(body)); err != nil {
+		return errors.Wrap(err, "writing message")
+	}
+
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "sending message")
+	}
+
+	return c.Quit()
+}
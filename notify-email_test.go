@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSmtpMessage is a mail as received by fakeSmtpServer
+type fakeSmtpMessage struct {
+	auth string // The AUTH PLAIN credentials given, if any
+	from string
+	to   []string
+	data string
+}
+
+// fakeSmtpServer accepts mail on a local port, handling just enough of
+// SMTP for net/smtp.  It doesn't offer STARTTLS.
+type fakeSmtpServer struct {
+	l        net.Listener
+	messages chan fakeSmtpMessage
+}
+
+func newFakeSmtpServer(t *testing.T) *fakeSmtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeSmtpServer{l, make(chan fakeSmtpMessage, 10)}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fs.serve(conn)
+		}
+	}()
+	return fs
+}
+
+func (fs *fakeSmtpServer) hostPort() (string, string) {
+	host, port, _ := net.SplitHostPort(fs.l.Addr().String())
+	return host, port
+}
+
+func (fs *fakeSmtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	msg := fakeSmtpMessage{}
+
+	tp.PrintfLine("220 localhost fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			creds, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			msg.auth = string(creds)
+			tp.PrintfLine("235 Authenticated")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			msg.data = strings.Join(data, "\n")
+			tp.PrintfLine("250 Queued")
+			fs.messages <- msg
+			msg = fakeSmtpMessage{}
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+// receive returns the next message, which must already have been sent
+func (fs *fakeSmtpServer) receive(t *testing.T) fakeSmtpMessage {
+	t.Helper()
+	select {
+	case msg := <-fs.messages:
+		return msg
+	default:
+		t.Fatal("no message received")
+	}
+	return fakeSmtpMessage{}
+}
+
+func newTestEmailNotifier(t *testing.T, fs *fakeSmtpServer) *EmailNotifier {
+	host, port := fs.hostPort()
+	t.Setenv("ICESCRAPER_SMTP_HOST", host)
+	t.Setenv("ICESCRAPER_SMTP_PORT", port)
+	t.Setenv("ICESCRAPER_SMTP_STARTTLS", "false")
+	t.Setenv("ICESCRAPER_SMTP_FROM", "scraper@example.com")
+	t.Setenv("ICESCRAPER_SMTP_TO", "a@example.com, b@example.com")
+	return newEmailNotifierFromEnv()
+}
+
+func TestEmailNotifierFromEnv(t *testing.T) {
+	t.Setenv("ICESCRAPER_SMTP_HOST", "")
+	if en := newEmailNotifierFromEnv(); en != nil {
+		t.Errorf("notifier configured without a host")
+	}
+
+	t.Setenv("ICESCRAPER_SMTP_HOST", "mail.example.com")
+	t.Setenv("ICESCRAPER_SMTP_PORT", "")
+	t.Setenv("ICESCRAPER_SMTP_STARTTLS", "")
+	t.Setenv("ICESCRAPER_SMTP_TO", "a@example.com,, b@example.com ")
+	en := newEmailNotifierFromEnv()
+	if en.port != DefaultSmtpPort || !en.startTLS {
+		t.Errorf("port %v and STARTTLS %v, want %v and on by default", en.port, en.startTLS, DefaultSmtpPort)
+	}
+	if strings.Join(en.to, ",") != "a@example.com,b@example.com" {
+		t.Errorf("recipients %q", en.to)
+	}
+
+	t.Setenv("ICESCRAPER_SMTP_STARTTLS", "false")
+	if newEmailNotifierFromEnv().startTLS {
+		t.Errorf("STARTTLS not turned off")
+	}
+}
+
+func TestEmailNotifierAlerts(t *testing.T) {
+	fs := newFakeSmtpServer(t)
+	en := newTestEmailNotifier(t, fs)
+
+	before, evCtx := testSession(0)
+	freed, _ := testSession(2)
+	cancelled, _ := testSession(0)
+	cancelled.Cancelled = true
+
+	// Spaces being taken isn't worth a mail
+	if err := en.NotifyChange(SessionChange{EventContext: evCtx, Previous: &freed, Current: before}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-fs.messages:
+		t.Fatalf("mail sent for spaces being taken: %v", msg.data)
+	default:
+	}
+
+	tests := []struct {
+		change  SessionChange
+		subject string
+	}{
+		{SessionChange{EventContext: evCtx, Previous: &before, Current: freed},
+			"Subject: Spaces available: Public Skating 2026-10-19 18:00:00"},
+		{SessionChange{EventContext: evCtx, Previous: &before, Current: cancelled},
+			"Subject: Session cancelled: Public Skating 2026-10-19 18:00:00"},
+	}
+	for _, test := range tests {
+		if err := en.NotifyChange(test.change); err != nil {
+			t.Fatalf("sending %q: %v", test.subject, err)
+		}
+		msg := fs.receive(t)
+		if !strings.Contains(msg.data, test.subject) {
+			t.Errorf("message doesn't have %q:\n%v", test.subject, msg.data)
+		}
+		if msg.from != "scraper@example.com" || strings.Join(msg.to, ",") != "a@example.com,b@example.com" {
+			t.Errorf("sent from %v to %v", msg.from, msg.to)
+		}
+		if msg.auth != "" {
+			t.Errorf("authenticated without a user configured")
+		}
+	}
+}
+
+func TestEmailNotifierDigest(t *testing.T) {
+	fs := newFakeSmtpServer(t)
+	en := newTestEmailNotifier(t, fs)
+
+	ev, evCtx := testSession(40)
+	days := []DaySummary{{evCtx.Day, []summary{summariseEvent(ev.EventInfo)}}}
+	if err := en.NotifyDigest(days); err != nil {
+		t.Fatal(err)
+	}
+	msg := fs.receive(t)
+	if !strings.Contains(msg.data, "Subject: Ice sessions from ") {
+		t.Errorf("digest has the wrong subject:\n%v", msg.data)
+	}
+	if !strings.Contains(msg.data, evCtx.Day) || !strings.Contains(msg.data, "Public Skating") {
+		t.Errorf("digest doesn't list the session:\n%v", msg.data)
+	}
+
+	if err := en.NotifyDigest(nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg := fs.receive(t); !strings.Contains(msg.data, "No sessions found.") {
+		t.Errorf("empty digest doesn't say so:\n%v", msg.data)
+	}
+}
+
+func TestEmailNotifierAuth(t *testing.T) {
+	fs := newFakeSmtpServer(t)
+	t.Setenv("ICESCRAPER_SMTP_USER", "scraper")
+	t.Setenv("ICESCRAPER_SMTP_PASSWORD", "secret")
+	en := newTestEmailNotifier(t, fs)
+
+	if err := en.NotifyDigest(nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg := fs.receive(t); msg.auth != "\x00scraper\x00secret" {
+		t.Errorf("authenticated with %q", msg.auth)
+	}
+}
+
+func TestEmailNotifierRequiresStartTLS(t *testing.T) {
+	fs := newFakeSmtpServer(t)
+	en := newTestEmailNotifier(t, fs)
+	en.startTLS = true
+
+	// The server doesn't offer STARTTLS, so nothing should be sent
+	err := en.NotifyDigest(nil)
+	if err == nil || !strings.Contains(err.Error(), "starting tls") {
+		t.Errorf("sending without STARTTLS gave %v", err)
+	}
+	select {
+	case <-fs.messages:
+		t.Errorf("message sent without STARTTLS")
+	default:
+	}
+}
+
+func TestEmailNotifierTimesOut(t *testing.T) {
+	// A server which accepts the connection but never greets us
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	saved := smtpTimeout
+	t.Cleanup(func() { smtpTimeout = saved })
+	smtpTimeout = 100 * time.Millisecond
+
+	en := newTestEmailNotifier(t, newFakeSmtpServer(t))
+	en.host, en.port, _ = net.SplitHostPort(l.Addr().String())
+
+	start := time.Now()
+	if err := en.NotifyDigest(nil); err == nil {
+		t.Errorf("sent to a silent server")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("gave up after %v", d)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// SessionChange describes a change in a session's details, as detected
+// by updateEvent.  Previous is nil if the session has just been discovered.
+type SessionChange struct {
+	EventContext
+	Previous *timestampedEventInfo
+	Current  timestampedEventInfo
+
+	// Sequence is the key of the snapshot in the session's bucket, and
+	// Cursor its position in the changes log
+	Sequence uint64
+	Cursor   uint64
+}
+
+// IsCancellation reports whether this change cancels the session
+func (sc SessionChange) IsCancellation() bool {
+	return sc.Current.Cancelled && (sc.Previous == nil || !sc.Previous.Cancelled)
+}
+
+// SpacesFreed reports whether spaces have become available in a session
+// that was already known about
+func (sc SessionChange) SpacesFreed() bool {
+	if sc.Previous == nil || sc.Current.Cancelled {
+		return false
+	}
+	return sc.Current.AvailableSpaces > sc.Previous.AvailableSpaces ||
+		sc.Current.AvailableFreeSpaces > sc.Previous.AvailableFreeSpaces
+}
+
+// Notifier is a sink for session changes and daily digests.  Each notifier
+// decides for itself which changes are interesting enough to report.
+type Notifier interface {
+	NotifyChange(sc SessionChange) error
+	NotifyDigest(days []DaySummary) error
+}
+
+var notifiers []Notifier
+
+func setupNotifiers() {
+	if en := newEmailNotifierFromEnv(); en != nil {
+		notifiers = append(notifiers, en)
+	}
+	for _, cn := range newChatNotifiersFromEnv() {
+		notifiers = append(notifiers, cn)
+	}
+}
+
+// notifyChange passes the change to every configured notifier.  Failures
+// are logged but otherwise ignored, as for calendar updates.
+func notifyChange(sc SessionChange) {
+	for _, n := range notifiers {
+		if err := n.NotifyChange(sc); err != nil {
+			slog.Error("Can't send change notification", "day", sc.Day, "product", sc.Product, "session", sc.Current.SessionId, "err", err)
+		}
+	}
+}
+
+const DefaultDigestDays = 7
+
+// sendDigest sends a summary of the coming days to every configured notifier
+func sendDigest(db *bolt.DB) error {
+	days := DefaultDigestDays
+	if d := os.Getenv("ICESCRAPER_DIGEST_DAYS"); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil {
+			slog.Error("Can't parse digest days", "err", err)
+			return err
+		}
+	}
+
+	summaries, err := collectSummaries(db, days)
+	if err != nil {
+		slog.Error("Can't summarise db", "err", err)
+		return err
+	}
+
+	for _, n := range notifiers {
+		if err := n.NotifyDigest(summaries); err != nil {
+			slog.Error("Can't send digest", "err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// The outbox holds calendar pushes that have failed, so that they can be
+// retried rather than lost.  Items are keyed by calendar and session, so
+// only the most recent failed update for each session is kept.  Items
+// which keep failing are eventually given up on, but left in the outbox to
+// be reported until the session is next updated.
+
+var outboxBucket = []byte("outbox")
+
+// outboxItem is a calendar push waiting to be retried
+type outboxItem struct {
+	Target string
+	EventContext
+	Event    timestampedEventInfo
+	Sequence uint64
+
+	Attempts    int
+	LastError   string
+	QueuedAt    time.Time
+	NextAttempt time.Time
+}
+
+func (oi outboxItem) key() []byte {
+	return []byte(oi.Target + "|" + oi.Event.SessionId)
+}
+
+// outboxStuckAttempts is the number of attempts after which an item is
+// reported as stuck
+const outboxStuckAttempts = 5
+
+// outboxMaxBackoff limits how long we wait between attempts
+const outboxMaxBackoff = 6 * time.Hour
+
+// outboxMaxAttempts is the number of attempts after which an item is no
+// longer retried
+const outboxMaxAttempts = 10
+
+func (oi outboxItem) stuck() bool {
+	return oi.Attempts >= outboxStuckAttempts
+}
+
+func (oi outboxItem) givenUp() bool {
+	return oi.Attempts >= outboxMaxAttempts
+}
+
+// outboxHistory returns the snapshots of the session before the queued
+// one, which aren't stored with the item
+func outboxHistory(tx *bolt.Tx, item outboxItem) ([]timestampedEventInfo, error) {
+	b := tx.Bucket([]byte(item.Day))
+	if b != nil {
+		b = b.Bucket([]byte("events"))
+	}
+	if b != nil {
+		b = b.Bucket([]byte(item.Event.SessionId))
+	}
+	if b == nil {
+		return nil, nil
+	}
+
+	history, err := getHistory(b)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(history)) > item.Sequence {
+		history = history[:item.Sequence]
+	}
+	return history, nil
+}
+
+// enqueueOutbox records a failed push, replacing any older one for the
+// same session and calendar
+func enqueueOutbox(tx *bolt.Tx, item outboxItem) error {
+	b, err := tx.CreateBucketIfNotExists(outboxBucket)
+	if err != nil {
+		return errors.Wrap(err, "creating outbox bucket")
+	}
+
+	now := time.Now()
+	item.QueuedAt = now
+	item.NextAttempt = now
+
+	return putOutboxItem(b, item)
+}
+
+func putOutboxItem(b *bolt.Bucket, item outboxItem) error {
+	itemJson, err := json.Marshal(item)
+	if err != nil {
+		return errors.Wrap(err, "marshalling outbox item")
+	}
+	return b.Put(item.key(), itemJson)
+}
+
+// dequeueOutbox removes any queued push for the same session and calendar
+func dequeueOutbox(tx *bolt.Tx, item outboxItem) error {
+	b := tx.Bucket(outboxBucket)
+	if b == nil {
+		return nil
+	}
+	return b.Delete(item.key())
+}
+
+// drainOutbox retries each queued push which is due, backing off
+// exponentially after each failure
+func drainOutbox(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b == nil {
+			return nil
+		}
+
+		now := time.Now()
+		var retried, succeeded int
+
+		// Collect the items first, as the bucket can't be modified whilst
+		// iterating over it
+		var items []outboxItem
+		if err := b.ForEach(func(k, v []byte) error {
+			item := outboxItem{}
+			if err := json.Unmarshal(v, &item); err != nil {
+				return errors.Wrapf(err, "parsing outbox item %s", k)
+			}
+			if !item.NextAttempt.After(now) && !item.givenUp() {
+				items = append(items, item)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			sink := sinkForTarget(tx, item.Target)
+			if sink == nil {
+				// Leave it queued in case the calendar is configured again
+				slog.Warn("No calendar configured for queued event", "target", item.Target, "day", item.Day, "product", item.Product, "session", item.Event.SessionId)
+				continue
+			}
+
+			retried++
+			history, err := outboxHistory(tx, item)
+			if err != nil {
+				return err
+			}
+			item.History = history
+			err = sink.PublishEvent(item.Event, item.EventContext, item.Sequence)
+			if err == nil {
+				succeeded++
+				if err := b.Delete(item.key()); err != nil {
+					return errors.Wrap(err, "removing outbox item")
+				}
+				continue
+			}
+
+			calendarPushFailures.Inc(sinkKind(item.Target))
+			item.Attempts++
+			item.LastError = err.Error()
+			item.NextAttempt = now.Add(outboxBackoff(item.Attempts))
+			if item.givenUp() {
+				slog.Error("Giving up on queued calendar event", "target", item.Target, "day", item.Day, "product", item.Product, "session", item.Event.SessionId, "err", err)
+			}
+			if err := putOutboxItem(b, item); err != nil {
+				return err
+			}
+		}
+
+		if retried > 0 {
+			slog.Info("Retried queued calendar events", "retried", retried, "succeeded", succeeded)
+		}
+		return nil
+	})
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Minute << uint(attempts)
+	if backoff > outboxMaxBackoff || backoff <= 0 {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
+
+// showOutbox lists the queued pushes, marking those which are stuck or
+// given up on
+func showOutbox(db *bolt.DB, out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "Date\tStart\tType\tCalendar\tQueued\tAttempts\tNext\tError\n")
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			item := outboxItem{}
+			if err := json.Unmarshal(v, &item); err != nil {
+				return errors.Wrapf(err, "parsing outbox item %s", k)
+			}
+
+			attempts := fmt.Sprint(item.Attempts)
+			next := item.NextAttempt.Format(time.Stamp)
+			if item.givenUp() {
+				attempts += " (given up)"
+				next = "-"
+			} else if item.stuck() {
+				attempts += " (stuck)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				item.Day, item.Event.StartTime, item.Event.ProductName, item.Target,
+				item.QueuedAt.Format(time.Stamp), attempts, next, item.LastError)
+			return nil
+		})
+	}); err != nil {
+		slog.Error("Can't show outbox", "err", err)
+	}
+
+	w.Flush()
+}
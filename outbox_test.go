@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// useCaldavOutbox sets up prod-a to push to a fake CalDAV collection, with
+// a description showing how many earlier snapshots the push had
+func useCaldavOutbox(t *testing.T) (*fakeCaldav, string) {
+	fc, srv := newFakeCaldav(t)
+	collection := srv.URL + "/cal/"
+
+	templates := EventTemplates{Description: "{{len .History}} earlier"}
+	if err := templates.compile(); err != nil {
+		t.Fatal(err)
+	}
+	useProducts(t, map[ProductId]ProductConfig{"prod-a": {CalDAV: collection, Templates: templates}})
+
+	saved := CalDAVClient
+	t.Cleanup(func() { CalDAVClient = saved })
+	CalDAVClient = http.DefaultClient
+
+	return fc, caldavTargetPrefix + collection
+}
+
+// outboxItems returns the queued items by target
+func outboxItems(t *testing.T, db *bolt.DB) map[string]outboxItem {
+	t.Helper()
+	items := map[string]outboxItem{}
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			item := outboxItem{}
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			items[item.Target] = item
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+// makeOutboxItemDue changes a queued item as if its next attempt is due
+func makeOutboxItemDue(t *testing.T, db *bolt.DB, item outboxItem, attempts int) {
+	t.Helper()
+	item.Attempts = attempts
+	item.NextAttempt = time.Now().Add(-time.Second)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return putOutboxItem(tx.Bucket(outboxBucket), item)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxRetries(t *testing.T) {
+	fc, target := useCaldavOutbox(t)
+	db := openTestDb(t)
+
+	first, evCtx := testSession(50)
+	second, _ := testSession(40)
+	putTestSnapshots(t, db, evCtx.Day, evCtx.Product, first, second)
+
+	// The push of the second snapshot fails, and is queued
+	fc.failWith = http.StatusServiceUnavailable
+	evCtx.History = []timestampedEventInfo{first}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		optionallyUpdateCalendar(tx, second, evCtx, 1)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	item, ok := outboxItems(t, db)[target]
+	if !ok || item.Attempts != 0 || !strings.Contains(item.LastError, "503") || item.NextAttempt.After(time.Now()) {
+		t.Fatalf("queued %+v", item)
+	}
+	fc.takeRequests()
+
+	// Failed retries back off
+	if err := drainOutbox(db); err != nil {
+		t.Fatal(err)
+	}
+	item = outboxItems(t, db)[target]
+	if wait := time.Until(item.NextAttempt); item.Attempts != 1 || wait < time.Minute || wait > 2*time.Minute {
+		t.Errorf("after a failed retry, attempts %v and next in %v", item.Attempts, wait)
+	}
+	fc.takeRequests()
+	if err := drainOutbox(db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fc.takeRequests(); len(got) != 0 {
+		t.Errorf("retried before due: %q", got)
+	}
+
+	// A successful retry is removed, and has the session's history
+	fc.failWith = 0
+	makeOutboxItemDue(t, db, item, 1)
+	if err := drainOutbox(db); err != nil {
+		t.Fatal(err)
+	}
+	if items := outboxItems(t, db); len(items) != 0 {
+		t.Errorf("left queued %+v", items)
+	}
+	body := fc.objects["/cal/"+sessionEventId(second.SessionId)+".ics"]
+	if !strings.Contains(body, "\r\nDESCRIPTION:1 earlier\r\n") || !strings.Contains(body, "\r\nSEQUENCE:1\r\n") {
+		t.Errorf("retried push:\n%v", body)
+	}
+}
+
+func TestOutboxGivesUp(t *testing.T) {
+	fc, target := useCaldavOutbox(t)
+	db := openTestDb(t)
+
+	ev, evCtx := testSession(50)
+	putTestSnapshots(t, db, evCtx.Day, evCtx.Product, ev)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return enqueueOutbox(tx, outboxItem{Target: target, EventContext: evCtx, Event: ev})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fc.failWith = http.StatusInternalServerError
+
+	makeOutboxItemDue(t, db, outboxItems(t, db)[target], outboxStuckAttempts-1)
+	if err := drainOutbox(db); err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	showOutbox(db, out)
+	if !strings.Contains(out.String(), " 5 (stuck) ") || !strings.Contains(out.String(), "500 Internal Server Error") {
+		t.Errorf("stuck item shown as:\n%v", out)
+	}
+
+	makeOutboxItemDue(t, db, outboxItems(t, db)[target], outboxMaxAttempts-1)
+	if err := drainOutbox(db); err != nil {
+		t.Fatal(err)
+	}
+	fc.takeRequests()
+
+	// It's no longer retried, but is still shown
+	makeOutboxItemDue(t, db, outboxItems(t, db)[target], outboxMaxAttempts)
+	if err := drainOutbox(db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fc.takeRequests(); len(got) != 0 {
+		t.Errorf("retried after giving up: %q", got)
+	}
+	out.Reset()
+	showOutbox(db, out)
+	if !strings.Contains(out.String(), " 10 (given up) ") {
+		t.Errorf("given up item shown as:\n%v", out)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: 2 * time.Minute, 3: 8 * time.Minute, 9: outboxMaxBackoff, 100: outboxMaxBackoff} {
+		if got := outboxBackoff(attempts); got != want {
+			t.Errorf("backoff after %v attempts is %v, want %v", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// EventInfo only holds the fields we use, so the whole of each session's
+// JSON object from the booking site is kept alongside its snapshot,
+// compressed.  Fields added to the model later can then be filled in for
+// the sessions already seen.  The site can change fields we don't use
+// without changing those we do, in which case the payload is kept under
+// the latest snapshot's key followed by the time it was seen.
+//
+// The payloads live in the day's bucket rather than the session's, as
+// everything in a session's bucket is taken to be a snapshot:
+// /<day>/raw/<session-id>/<snapshot-sequence>:gzip(json)
+// /<day>/raw/<session-id>/<snapshot-sequence><unix-nanoseconds>:gzip(json)
+
+var rawBucket = []byte("raw")
+
+// rawPayload is a payload kept for a session
+type rawPayload struct {
+	Snapshot uint64
+	Changed  time.Time // When it was seen, if not with the snapshot
+	Payload  json.RawMessage
+}
+
+// storeRawPayload keeps the payload for the snapshot stored under seqKey
+func storeRawPayload(tx *bolt.Tx, day, sid string, seqKey, payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	dayBucket := tx.Bucket([]byte(day))
+	if dayBucket == nil {
+		return errors.Errorf("no bucket for %v", day)
+	}
+	rb, err := dayBucket.CreateBucketIfNotExists(rawBucket)
+	if err != nil {
+		return errors.Wrap(err, "creating raw payload bucket")
+	}
+	sb, err := rb.CreateBucketIfNotExists([]byte(sid))
+	if err != nil {
+		return errors.Wrap(err, "creating raw payload bucket for session")
+	}
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(payload); err != nil {
+		return errors.Wrap(err, "compressing raw payload")
+	}
+	if err := zw.Close(); err != nil {
+		return errors.Wrap(err, "compressing raw payload")
+	}
+
+	return errors.Wrap(sb.Put(seqKey, buf.Bytes()), "storing raw payload")
+}
+
+// storeChangedRawPayload keeps the payload if it differs from the last one
+// kept for the session, when the snapshot stored under seqKey hasn't
+// changed
+func storeChangedRawPayload(tx *bolt.Tx, day, sid string, seqKey, payload []byte, seen time.Time) error {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	var latest []byte
+	if sb := rawSessionBucket(tx, day, sid); sb != nil {
+		if k, v := sb.Cursor().Last(); k != nil {
+			var err error
+			if latest, err = decompressRawPayload(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	if rawPayloadsEqual(latest, payload) {
+		return nil
+	}
+
+	key := make([]byte, 16)
+	copy(key, seqKey)
+	binary.BigEndian.PutUint64(key[8:], uint64(seen.UnixNano()))
+	return storeRawPayload(tx, day, sid, key, payload)
+}
+
+// rawPayloadsEqual compares payloads, ignoring their layout
+func rawPayloadsEqual(a, b []byte) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func rawSessionBucket(tx *bolt.Tx, day, sid string) *bolt.Bucket {
+	dayBucket := tx.Bucket([]byte(day))
+	if dayBucket == nil {
+		return nil
+	}
+	rb := dayBucket.Bucket(rawBucket)
+	if rb == nil {
+		return nil
+	}
+	return rb.Bucket([]byte(sid))
+}
+
+func decompressRawPayload(k, v []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(v))
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompressing raw payload %x", k)
+	}
+	payload, err := ioutil.ReadAll(zr)
+	return payload, errors.Wrapf(err, "decompressing raw payload %x", k)
+}
+
+// rawPayloads returns the payloads kept for a session, in the order they
+// were seen
+func rawPayloads(tx *bolt.Tx, day, sid string) ([]rawPayload, error) {
+	var payloads []rawPayload
+
+	sb := rawSessionBucket(tx, day, sid)
+	if sb == nil {
+		return payloads, nil
+	}
+
+	err := sb.ForEach(func(k, v []byte) error {
+		payload, err := decompressRawPayload(k, v)
+		if err != nil {
+			return err
+		}
+		rp := rawPayload{Snapshot: binary.BigEndian.Uint64(k), Payload: payload}
+		if len(k) == 16 {
+			rp.Changed = time.Unix(0, int64(binary.BigEndian.Uint64(k[8:])))
+		}
+		payloads = append(payloads, rp)
+		return nil
+	})
+	return payloads, err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// rawBookingSite answers every request with the same body
+type rawBookingSite string
+
+func (rs rawBookingSite) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(string(rs))),
+		Request:    req,
+	}, nil
+}
+
+func TestRawPayloadsKept(t *testing.T) {
+	db, day := newTestDay(t, "prod-a")
+
+	for _, body := range []string{
+		"[" + rawSession + `,"Colour":"red"}]`,
+		"[" + rawSession + `, "Colour": "red"}]`, // Only the layout differs
+		"[" + rawSession + `,"Colour":"blue"}]`,
+		"[" + strings.Replace(rawSession, `"AvailableSpaces":50`, `"AvailableSpaces":40`, 1) + `,"Colour":"blue"}]`,
+	} {
+		evs, err := getEventsInfo(bookingClient{Client: &http.Client{Transport: rawBookingSite(body)}}, day, "prod-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(*evs) != 1 || (*evs)[0].SessionId != "1" || !strings.Contains(string((*evs)[0].raw), `"Colour"`) {
+			t.Fatalf("decoded %+v from %v", *evs, body)
+		}
+
+		if err := db.Update(func(tx *bolt.Tx) error {
+			evBucket, err := tx.Bucket([]byte(day)).CreateBucketIfNotExists([]byte("events"))
+			if err != nil {
+				return err
+			}
+			ev := timestampedEventInfo{(*evs)[0], time.Now(), false, "prod-a"}
+			return updateEvent(evBucket, EventContext{Day: day, Product: "prod-a"}, ev)
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		payloads, err := rawPayloads(tx, day, "1")
+		if err != nil {
+			return err
+		}
+
+		// The colour changing is kept with the first snapshot, and the
+		// spaces changing with a snapshot of its own
+		want := []struct {
+			snapshot uint64
+			changed  bool
+		}{{1, false}, {1, true}, {2, false}}
+		var got []string
+		for i, p := range payloads {
+			got = append(got, string(p.Payload))
+			if i < len(want) && (p.Snapshot != want[i].snapshot || p.Changed.IsZero() == want[i].changed) {
+				t.Errorf("payload %v is for snapshot %v, changed at %v", i, p.Snapshot, p.Changed)
+			}
+		}
+		if len(got) != 3 || !strings.Contains(got[1], `"blue"`) || !strings.Contains(got[2], `"AvailableSpaces":40`) {
+			t.Errorf("payloads kept:\n%v", strings.Join(got, "\n"))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotsDecodeWithoutRaw(t *testing.T) {
+	// Snapshots embed EventInfo, so must still decode all their fields
+	evs := EventsInfo{}
+	if err := evs.UnmarshalJSON([]byte("[" + rawSession + "}]")); err != nil {
+		t.Fatal(err)
+	}
+	ev := timestampedEventInfo{evs[0], time.Now().Round(0), true, "prod-a"}
+
+	history := []timestampedEventInfo{}
+	db, day := newTestDay(t, "prod-a")
+	if err := db.Update(func(tx *bolt.Tx) error {
+		evBucket, err := tx.Bucket([]byte(day)).CreateBucketIfNotExists([]byte("events"))
+		if err != nil {
+			return err
+		}
+		if err := updateEvent(evBucket, EventContext{Day: day, Product: "prod-a"}, ev); err != nil {
+			return err
+		}
+		history, err = getHistory(evBucket.Bucket([]byte("1")))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ev.raw = nil
+	if len(history) != 1 || !history[0].UpdatedAt.Equal(ev.UpdatedAt) || !history[0].Cancelled ||
+		history[0].Product != "prod-a" || !reflect.DeepEqual(history[0].EventInfo, ev.EventInfo) {
+		t.Errorf("snapshot decoded as %+v, want %+v", history, ev)
+	}
+}
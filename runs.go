@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Every run of the checks, whether from cron or the daemon, is recorded in
+// the runs bucket, so that the health check can spot the scraper quietly
+// failing, e.g. when the venue changes its site.  The latest success of
+// each command is also kept, so that it's found without a search.
+
+var (
+	runsBucket        = []byte("runs")
+	lastSuccessBucket = []byte("last-success")
+)
+
+// runRetention is how long runs are kept for
+const runRetention = 30 * 24 * time.Hour
+
+type runRecord struct {
+	Id      string
+	Command string
+	Start   time.Time
+	End     time.Time
+	Success bool
+	Error   string `json:",omitempty"`
+
+	// What the run did.  The daemon's checks can run at the same time, in
+	// which case these include work done by the others.
+	Requests      int
+	Snapshots     int
+	Cancellations int
+}
+
+// trackRun runs a command, recording it in the database and the metrics
+func trackRun(db *bolt.DB, command, runId string, run func(db *bolt.DB) error) error {
+	rec := runRecord{Id: runId, Command: command, Start: time.Now()}
+	requests, snapshots, cancellations := httpRequests.Total(), snapshotsWritten.Total(), cancellationsDetected.Total()
+
+	err := run(db)
+
+	rec.End = time.Now()
+	rec.Success = err == nil
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	rec.Requests = int(httpRequests.Total() - requests)
+	rec.Snapshots = int(snapshotsWritten.Total() - snapshots)
+	rec.Cancellations = int(cancellationsDetected.Total() - cancellations)
+
+	recordRun(command, err)
+	if dbErr := db.Update(func(tx *bolt.Tx) error { return storeRun(tx, rec) }); dbErr != nil {
+		slog.Error("Can't record run", "err", dbErr)
+	}
+
+	return err
+}
+
+// storeRun adds the run to the history, dropping runs that have expired
+func storeRun(tx *bolt.Tx, rec runRecord) error {
+	b, err := tx.CreateBucketIfNotExists(runsBucket)
+	if err != nil {
+		return errors.Wrap(err, "creating runs bucket")
+	}
+
+	recJson, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "marshalling run")
+	}
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return errors.Wrap(err, "numbering run")
+	}
+	if err := b.Put(sequenceKey(seq), recJson); err != nil {
+		return errors.Wrap(err, "storing run")
+	}
+
+	if rec.Success {
+		ls, err := tx.CreateBucketIfNotExists(lastSuccessBucket)
+		if err != nil {
+			return errors.Wrap(err, "creating last success bucket")
+		}
+		if err := ls.Put([]byte(rec.Command), recJson); err != nil {
+			return errors.Wrap(err, "storing last success")
+		}
+	}
+
+	// Runs are stored in order, so the expired ones are at the start
+	cutoff := rec.Start.Add(-runRetention)
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		old := runRecord{}
+		if err := json.Unmarshal(v, &old); err == nil && old.Start.After(cutoff) {
+			break
+		}
+		if err := b.Delete(k); err != nil {
+			return errors.Wrap(err, "removing expired run")
+		}
+	}
+
+	return nil
+}
+
+// lastSuccessfulRun returns the latest successful run of the command, or
+// nil if there's never been one
+func lastSuccessfulRun(tx *bolt.Tx, command string) (*runRecord, error) {
+	b := tx.Bucket(lastSuccessBucket)
+	if b == nil {
+		return nil, nil
+	}
+	recJson := b.Get([]byte(command))
+	if recJson == nil {
+		return nil, nil
+	}
+
+	rec := &runRecord{}
+	if err := json.Unmarshal(recJson, rec); err != nil {
+		return nil, errors.Wrapf(err, "parsing last success of %v", command)
+	}
+	return rec, nil
+}
+
+// healthRequirement is how recently a command must have succeeded
+type healthRequirement struct {
+	command string
+	envVar  string
+	maxAge  time.Duration
+}
+
+var healthRequirements = []healthRequirement{
+	{"check-calendar", "ICESCRAPER_HEALTH_CHECK_CALENDAR_MAX_AGE", 36 * time.Hour},
+	{"check-events", "ICESCRAPER_HEALTH_CHECK_EVENTS_MAX_AGE", 5 * time.Hour},
+}
+
+// checkHealth returns a description of each problem found
+func checkHealth(db *bolt.DB) ([]string, error) {
+	var problems []string
+	err := db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		for _, hr := range healthRequirements {
+			maxAge := hr.maxAge
+			if a := os.Getenv(hr.envVar); a != "" {
+				var err error
+				if maxAge, err = time.ParseDuration(a); err != nil {
+					return errors.Wrapf(err, "parsing %v", hr.envVar)
+				}
+			}
+
+			rec, err := lastSuccessfulRun(tx, hr.command)
+			if err != nil {
+				return err
+			}
+			if rec == nil {
+				problems = append(problems, fmt.Sprintf("%v has never succeeded", hr.command))
+			} else if age := now.Sub(rec.End); age > maxAge {
+				problems = append(problems, fmt.Sprintf("%v last succeeded %v ago, at %v",
+					hr.command, age.Round(time.Second), rec.End.Format(time.RFC3339)))
+			}
+		}
+
+		// Responses which can't be decoded properly give zeros rather
+		// than errors, so the checks can succeed regardless
+		states, err := schemaStates(tx)
+		if err != nil {
+			return err
+		}
+		for endpoint, state := range states {
+			if state.Report.Broken() {
+				problems = append(problems, fmt.Sprintf("%v responses haven't decoded properly since %v: %v",
+					endpoint, state.Since.Format(time.RFC3339), state.Report))
+			}
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// healthCommand reports on the health of the scraper, failing if it's
+// unhealthy so that it can be used from monitoring scripts
+func healthCommand(db *bolt.DB) error {
+	problems, err := checkHealth(db)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		return errors.New("unhealthy")
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+// healthHandler serves the health check, for load balancers and uptime
+// monitors
+func healthHandler(db *bolt.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		problems, err := checkHealth(db)
+		if err != nil {
+			slog.Error("Can't check health", "err", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// storedRuns returns the runs in the history, oldest first
+func storedRuns(t *testing.T, db *bolt.DB) []runRecord {
+	t.Helper()
+	var runs []runRecord
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(runsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			rec := runRecord{}
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			runs = append(runs, rec)
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return runs
+}
+
+func TestTrackRun(t *testing.T) {
+	resetMetrics()
+	t.Cleanup(resetMetrics)
+	db := openTestDb(t)
+
+	if err := trackRun(db, "check-events", "run-1", func(*bolt.DB) error {
+		httpRequests.Inc("booking", "200")
+		httpRequests.Inc("booking", "200")
+		snapshotsWritten.Inc()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("site changed")
+	if err := trackRun(db, "check-events", "run-2", func(*bolt.DB) error { return failure }); err != failure {
+		t.Errorf("failed run gave %v", err)
+	}
+
+	runs := storedRuns(t, db)
+	if len(runs) != 2 {
+		t.Fatalf("stored %+v", runs)
+	}
+	if r := runs[0]; r.Id != "run-1" || !r.Success || r.Requests != 2 || r.Snapshots != 1 || r.End.Before(r.Start) {
+		t.Errorf("successful run stored as %+v", r)
+	}
+	if r := runs[1]; r.Id != "run-2" || r.Success || r.Error != "site changed" || r.Requests != 0 {
+		t.Errorf("failed run stored as %+v", r)
+	}
+
+	// The failure doesn't replace the last success
+	if err := db.View(func(tx *bolt.Tx) error {
+		rec, err := lastSuccessfulRun(tx, "check-events")
+		if err != nil || rec == nil || rec.Id != "run-1" {
+			t.Errorf("last success %+v (%v), want run-1", rec, err)
+		}
+		if rec, _ := lastSuccessfulRun(tx, "check-calendar"); rec != nil {
+			t.Errorf("last success of a command never run %+v", rec)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreRunRetention(t *testing.T) {
+	db := openTestDb(t)
+	now := time.Now()
+
+	for i, age := range []time.Duration{runRetention + time.Hour, runRetention - time.Hour, 0} {
+		rec := runRecord{Id: string(rune('a' + i)), Command: "check-events", Start: now.Add(-age), End: now.Add(-age)}
+		if err := db.Update(func(tx *bolt.Tx) error { return storeRun(tx, rec) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ids []string
+	for _, r := range storedRuns(t, db) {
+		ids = append(ids, r.Id)
+	}
+	if strings.Join(ids, ",") != "b,c" {
+		t.Errorf("kept runs %v, want b,c", ids)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name     string
+		ages     map[string]time.Duration // of the last success of each command
+		env      string                   // ICESCRAPER_HEALTH_CHECK_EVENTS_MAX_AGE
+		problems []string
+	}{
+		{"fresh", map[string]time.Duration{"check-calendar": 30 * time.Hour, "check-events": time.Hour}, "", nil},
+		{"never run", map[string]time.Duration{"check-events": time.Hour}, "", []string{"check-calendar has never succeeded"}},
+		{"stale", map[string]time.Duration{"check-calendar": 40 * time.Hour, "check-events": 6 * time.Hour}, "",
+			[]string{"check-calendar last succeeded 40h0m0s ago", "check-events last succeeded 6h0m0s ago"}},
+		{"max age set", map[string]time.Duration{"check-calendar": time.Hour, "check-events": 6 * time.Hour}, "7h", nil},
+		{"max age exceeded", map[string]time.Duration{"check-calendar": time.Hour, "check-events": 2 * time.Hour}, "90m",
+			[]string{"check-events last succeeded 2h0m0s ago"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ICESCRAPER_HEALTH_CHECK_EVENTS_MAX_AGE", tc.env)
+			db := openTestDb(t)
+			for command, age := range tc.ages {
+				rec := runRecord{Command: command, Start: now.Add(-age), End: now.Add(-age), Success: true}
+				if err := db.Update(func(tx *bolt.Tx) error { return storeRun(tx, rec) }); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			problems, err := checkHealth(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) != len(tc.problems) {
+				t.Fatalf("problems %q, want %q", problems, tc.problems)
+			}
+			for i, p := range problems {
+				if !strings.HasPrefix(p, tc.problems[i]) {
+					t.Errorf("problem %q, want %q", p, tc.problems[i])
+				}
+			}
+		})
+	}
+
+	t.Setenv("ICESCRAPER_HEALTH_CHECK_EVENTS_MAX_AGE", "soon")
+	if _, err := checkHealth(openTestDb(t)); err == nil {
+		t.Errorf("unparseable max age accepted")
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// The booking site's JSON is decoded leniently, so if its shape changes
+// we'd just see zeros.  Each response is also checked strictly against
+// the types it's decoded into, noting fields we don't know about, fields
+// we need which are missing, and values of the wrong type.  The site sends
+// much that we ignore, so unknown fields are only a concern when they
+// change, but missing or mismatched fields mean the data can't be trusted.
+//
+// What's seen during a run is kept in memory by the run's schemaObserver,
+// which travels with its bookingClient, until record compares it with what
+// was seen before, storing a sample of the raw response whenever it's
+// changed.  The daemon's checks can run at the same time, so each has an
+// observer of its own.
+
+var schemaBucket = []byte("schema")
+
+// schemaSampleLimit is the most samples kept for each endpoint
+const schemaSampleLimit = 20
+
+// schemaReport describes how a response differs from the type it's
+// decoded into, by the paths of the fields, e.g. "Dates[].HasEvent"
+type schemaReport struct {
+	Unknown    []string `json:",omitempty"`
+	Missing    []string `json:",omitempty"`
+	Mismatched []string `json:",omitempty"`
+}
+
+// Broken is true if the response couldn't be decoded properly
+func (sr schemaReport) Broken() bool {
+	return len(sr.Missing) > 0 || len(sr.Mismatched) > 0
+}
+
+func (sr schemaReport) Equal(other schemaReport) bool {
+	return reflect.DeepEqual(sr, other)
+}
+
+func (sr schemaReport) String() string {
+	var parts []string
+	if len(sr.Missing) > 0 {
+		parts = append(parts, "missing "+strings.Join(sr.Missing, ", "))
+	}
+	if len(sr.Mismatched) > 0 {
+		parts = append(parts, "mismatched "+strings.Join(sr.Mismatched, ", "))
+	}
+	if len(sr.Unknown) > 0 {
+		parts = append(parts, "unknown "+strings.Join(sr.Unknown, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// schemaState is what was last seen from an endpoint
+type schemaState struct {
+	Report schemaReport
+	Since  time.Time // When it was first seen
+	Seen   time.Time // When it was last seen
+}
+
+// schemaSample is a raw response kept when the shape changed
+type schemaSample struct {
+	Time    time.Time
+	Report  schemaReport
+	Payload json.RawMessage
+}
+
+// schemaObservation gathers what's been seen from an endpoint since it
+// was last recorded
+type schemaObservation struct {
+	fields  map[string]map[string]bool // unknown, missing, mismatched
+	payload []byte                     // A response, preferably a broken one
+	broken  bool
+}
+
+// schemaObserver gathers what's been seen from each endpoint during a run
+type schemaObserver struct {
+	mu           sync.Mutex
+	observations map[string]*schemaObservation
+}
+
+func newSchemaObserver() *schemaObserver {
+	return &schemaObserver{observations: map[string]*schemaObservation{}}
+}
+
+// decodeStrictly decodes the response leniently as before, and notes how
+// it differs from the type it's decoded into.  Without an observer, it's
+// just decoded.
+func (so *schemaObserver) decodeStrictly(endpoint string, data []byte, v interface{}) error {
+	if so == nil {
+		return json.Unmarshal(data, v)
+	}
+
+	report := map[string]map[string]bool{"unknown": {}, "missing": {}, "mismatched": {}}
+
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		// Perhaps an error page, which is worth keeping
+		report["mismatched"]["(not JSON)"] = true
+		so.observe(endpoint, report, data)
+		return err
+	}
+
+	// An empty list shows nothing of the shape, and would look like a
+	// change if it were compared
+	if arr, ok := raw.([]interface{}); ok && len(arr) == 0 {
+		return json.Unmarshal(data, v)
+	}
+
+	checkSchema("", raw, reflect.TypeOf(v).Elem(), report)
+	so.observe(endpoint, report, data)
+
+	return json.Unmarshal(data, v)
+}
+
+// checkSchema compares a decoded JSON value with a type, matching field
+// names as encoding/json does
+func checkSchema(path string, raw interface{}, t reflect.Type, report map[string]map[string]bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if raw == nil {
+		// Null decodes to the zero value of anything
+		return
+	}
+
+	mismatch := func() {
+		p := path
+		if p == "" {
+			p = "(response)"
+		}
+		report["mismatched"][fmt.Sprintf("%v (%v, not %v)", p, jsonTypeName(raw), t.Kind())] = true
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			mismatch()
+			return
+		}
+
+		matched := map[string]bool{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+
+			key, found := name, false
+			if _, found = obj[name]; !found {
+				for k := range obj {
+					if strings.EqualFold(k, name) {
+						key, found = k, true
+						break
+					}
+				}
+			}
+			if !found {
+				report["missing"][joinSchemaPath(path, name)] = true
+				continue
+			}
+			matched[key] = true
+			checkSchema(joinSchemaPath(path, name), obj[key], f.Type, report)
+		}
+
+		for k := range obj {
+			if !matched[k] {
+				report["unknown"][joinSchemaPath(path, k)] = true
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		arr, ok := raw.([]interface{})
+		if !ok {
+			mismatch()
+			return
+		}
+		for _, el := range arr {
+			checkSchema(path+"[]", el, t.Elem(), report)
+		}
+
+	case reflect.String:
+		if _, ok := raw.(string); !ok {
+			mismatch()
+		}
+
+	case reflect.Bool:
+		if _, ok := raw.(bool); !ok {
+			mismatch()
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := raw.(float64); !ok || n != float64(int64(n)) {
+			mismatch()
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if _, ok := raw.(float64); !ok {
+			mismatch()
+		}
+	}
+}
+
+func joinSchemaPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func jsonTypeName(raw interface{}) string {
+	switch raw.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	}
+	return "null"
+}
+
+// observe adds a response's report to what's been seen from the
+// endpoint.  The first response is kept as a sample, unless a later one
+// is broken, as that's the one worth looking at.
+func (so *schemaObserver) observe(endpoint string, report map[string]map[string]bool, payload []byte) {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	obs := so.observations[endpoint]
+	if obs == nil {
+		obs = &schemaObservation{fields: map[string]map[string]bool{"unknown": {}, "missing": {}, "mismatched": {}}}
+		so.observations[endpoint] = obs
+	}
+
+	for kind, paths := range report {
+		for p := range paths {
+			obs.fields[kind][p] = true
+		}
+	}
+
+	broken := len(report["missing"]) > 0 || len(report["mismatched"]) > 0
+	if obs.payload == nil || (broken && !obs.broken) {
+		obs.payload, obs.broken = payload, broken
+	}
+}
+
+func sortedPaths(paths map[string]bool) []string {
+	var sorted []string
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// take returns what's been seen since the last call
+func (so *schemaObserver) take() map[string]*schemaObservation {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	obs := so.observations
+	so.observations = map[string]*schemaObservation{}
+	return obs
+}
+
+// record compares what's been seen from each endpoint with what was seen
+// before, warning and keeping a sample if it's changed
+func (so *schemaObserver) record(tx *bolt.Tx) error {
+	observations := so.take()
+	if len(observations) == 0 {
+		return nil
+	}
+
+	sb, err := tx.CreateBucketIfNotExists(schemaBucket)
+	if err != nil {
+		return errors.Wrap(err, "creating schema bucket")
+	}
+
+	now := time.Now()
+	for endpoint, obs := range observations {
+		report := schemaReport{
+			Unknown:    sortedPaths(obs.fields["unknown"]),
+			Missing:    sortedPaths(obs.fields["missing"]),
+			Mismatched: sortedPaths(obs.fields["mismatched"]),
+		}
+
+		eb, err := sb.CreateBucketIfNotExists([]byte(endpoint))
+		if err != nil {
+			return errors.Wrapf(err, "creating schema bucket for %v", endpoint)
+		}
+
+		state := schemaState{Report: report, Since: now, Seen: now}
+		previous := schemaState{}
+		known := false
+		if stateJson := eb.Get([]byte("state")); stateJson != nil {
+			if err := json.Unmarshal(stateJson, &previous); err != nil {
+				return errors.Wrapf(err, "parsing schema state for %v", endpoint)
+			}
+			known = true
+		}
+
+		if known && previous.Report.Equal(report) {
+			state.Since = previous.Since
+		} else {
+			logger := slog.With("endpoint", endpoint, "unknown", report.Unknown,
+				"missing", report.Missing, "mismatched", report.Mismatched)
+			if !known {
+				logger.Info("Recording response schema")
+			} else {
+				schemaChanges.Inc(endpoint)
+				logger.Warn("Response schema has changed", "previous", previous.Report.String())
+			}
+			if err := storeSchemaSample(eb, schemaSample{now, report, obs.payload}); err != nil {
+				return err
+			}
+		}
+
+		if report.Broken() {
+			slog.Warn("Response doesn't match what's expected", "endpoint", endpoint,
+				"missing", report.Missing, "mismatched", report.Mismatched)
+		}
+
+		stateJson, err := json.Marshal(state)
+		if err != nil {
+			return errors.Wrap(err, "marshalling schema state")
+		}
+		if err := eb.Put([]byte("state"), stateJson); err != nil {
+			return errors.Wrapf(err, "storing schema state for %v", endpoint)
+		}
+	}
+
+	return nil
+}
+
+// save records what's been seen from the booking site in a transaction of
+// its own
+func (so *schemaObserver) save(db *bolt.DB) {
+	so.mu.Lock()
+	seen := len(so.observations) > 0
+	so.mu.Unlock()
+	if !seen {
+		return
+	}
+
+	if err := db.Update(so.record); err != nil {
+		slog.Error("Can't record response schema", "err", err)
+	}
+}
+
+// storeSchemaSample keeps the raw response, dropping the oldest samples
+func storeSchemaSample(eb *bolt.Bucket, sample schemaSample) error {
+	samples, err := eb.CreateBucketIfNotExists([]byte("samples"))
+	if err != nil {
+		return errors.Wrap(err, "creating schema samples bucket")
+	}
+
+	// Keep the payload as it was sent, if it's valid
+	if !json.Valid(sample.Payload) {
+		sample.Payload, _ = json.Marshal(string(sample.Payload))
+	} else {
+		sample.Payload = bytes.TrimSpace(sample.Payload)
+	}
+	sampleJson, err := json.Marshal(sample)
+	if err != nil {
+		return errors.Wrap(err, "marshalling schema sample")
+	}
+
+	seq, err := samples.NextSequence()
+	if err != nil {
+		return errors.Wrap(err, "numbering schema sample")
+	}
+	if err := samples.Put(sequenceKey(seq), sampleJson); err != nil {
+		return errors.Wrap(err, "storing schema sample")
+	}
+
+	n := 0
+	samples.ForEach(func(_, _ []byte) error { n++; return nil })
+
+	c := samples.Cursor()
+	for k, _ := c.First(); k != nil && n > schemaSampleLimit; k, _ = c.First() {
+		if err := samples.Delete(k); err != nil {
+			return errors.Wrap(err, "removing old schema sample")
+		}
+		n--
+	}
+	return nil
+}
+
+// schemaStates returns the last state seen from each endpoint
+func schemaStates(tx *bolt.Tx) (map[string]schemaState, error) {
+	states := map[string]schemaState{}
+	sb := tx.Bucket(schemaBucket)
+	if sb == nil {
+		return states, nil
+	}
+
+	err := sb.ForEach(func(endpoint, _ []byte) error {
+		eb := sb.Bucket(endpoint)
+		if eb == nil {
+			return nil
+		}
+		stateJson := eb.Get([]byte("state"))
+		if stateJson == nil {
+			return nil
+		}
+		state := schemaState{}
+		if err := json.Unmarshal(stateJson, &state); err != nil {
+			return errors.Wrapf(err, "parsing schema state for %v", endpoint)
+		}
+		states[string(endpoint)] = state
+		return nil
+	})
+	return states, err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// rawSession is a session as the booking site sends it, without the
+// closing brace so that fields can be added
+const rawSession = `{"SessionId":"1","ProductName":"Public Skating","Location":"Rink 1",` +
+	`"StartTime":"18:00:00","EndTime":"19:00:00","TotalSpaces":100,"AvailableSpaces":50,` +
+	`"CapacityFreeAcademy":0,"AvailableFreeSpaces":0`
+
+func TestSchemaObserversAreSeparate(t *testing.T) {
+	db, _ := newTestDay(t)
+
+	// Runs at the same time see different responses
+	a, b := newSchemaObserver(), newSchemaObserver()
+	var ei EventsInfo
+	if err := a.decodeStrictly("ice-sports-times", []byte("["+rawSession+`,"Colour":"red"}]`), &ei); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.decodeStrictly("ice-sports-calendar", []byte(`{"CurrentMonth":"May"}`), &Calendar{}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.save(db)
+	if err := db.View(func(tx *bolt.Tx) error {
+		states, err := schemaStates(tx)
+		if err != nil {
+			return err
+		}
+		if _, ok := states["ice-sports-calendar"]; ok {
+			t.Errorf("another run's observations were recorded")
+		}
+		if got := states["ice-sports-times"].Report; !reflect.DeepEqual(got, schemaReport{Unknown: []string{"[].Colour"}}) {
+			t.Errorf("recorded %+v", got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	b.save(db)
+	if err := db.View(func(tx *bolt.Tx) error {
+		states, err := schemaStates(tx)
+		if err != nil {
+			return err
+		}
+		if got := states["ice-sports-calendar"].Report; !got.Broken() {
+			t.Errorf("calendar missing its fields recorded as %+v", got)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
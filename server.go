@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The serve command runs as a long-lived daemon.  Bolt holds an exclusive
+// lock on the database whilst it is open, so the cron commands can't run
+// alongside it; instead the daemon runs the same checks on a schedule.
+
+const DefaultHttpAddr = ":8080"
+
+func serve(db *bolt.DB) error {
+	addr := os.Getenv("ICESCRAPER_HTTP_ADDR")
+	if addr == "" {
+		addr = DefaultHttpAddr
+	}
+
+	// Changes are streamed to clients, so this must be registered
+	// before the checks start
+	broadcaster := newChangeBroadcaster()
+	notifiers = append(notifiers, broadcaster)
+
+	for _, sc := range scheduledChecks {
+		go sc.runPeriodically(db)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/calendar.ics", icsHandler(db))
+	mux.HandleFunc("/calendar/", icsHandler(db))
+	handleApi(mux, db)
+	mux.HandleFunc("/api/changes", changesHandler(db, broadcaster))
+	mux.HandleFunc("/metrics", metricsHandler(db))
+	mux.HandleFunc("/healthz", healthHandler(db))
+	mux.HandleFunc("/", dashboardHandler)
+
+	slog.Info("Listening", "addr", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// icsHandler serves the combined calendar at /calendar.ics, and
+// per-product calendars at /calendar/<product-id>.ics
+func icsHandler(db *bolt.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var product ProductId
+		if r.URL.Path != "/calendar.ics" {
+			name := strings.TrimPrefix(r.URL.Path, "/calendar/")
+			if !strings.HasSuffix(name, ".ics") {
+				http.NotFound(w, r)
+				return
+			}
+			product = ProductId(strings.TrimSuffix(name, ".ics"))
+			if _, ok := productsMap[product]; !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		modTime, err := icsLastModified(db)
+		if err != nil {
+			slog.Error("Can't find calendar modification time", "err", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+
+		buf := &bytes.Buffer{}
+		if err := exportIcs(db, buf, product); err != nil {
+			slog.Error("Can't export calendar", "product", product, "err", err)
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		http.ServeContent(w, r, "calendar.ics", modTime, bytes.NewReader(buf.Bytes()))
+	}
+}
+
+// scheduledCheck is one of the cron commands, run periodically by the daemon.
+// The interval can be overridden from the environment, and "0" disables it.
+type scheduledCheck struct {
+	name     string
+	envVar   string
+	interval time.Duration
+	run      func(db *bolt.DB) error
+}
+
+var scheduledChecks = []scheduledCheck{
+	{"check-calendar", "ICESCRAPER_CHECK_CALENDAR_INTERVAL", 24 * time.Hour, checkForNewDays},
+	{"check-events", "ICESCRAPER_CHECK_EVENTS_INTERVAL", 4 * time.Hour,
+		func(db *bolt.DB) error { return checkForEvents(db, false) }},
+	{"check-todays-events", "ICESCRAPER_CHECK_TODAYS_EVENTS_INTERVAL", time.Hour,
+		func(db *bolt.DB) error { return checkForEvents(db, true) }},
+	{"check-if-events-starting-soon", "ICESCRAPER_CHECK_STARTING_SOON_INTERVAL", time.Minute, checkIfEventsStartingSoon},
+	{"drain-outbox", "ICESCRAPER_DRAIN_OUTBOX_INTERVAL", 15 * time.Minute, drainOutbox},
+	{"gcal-sync", "ICESCRAPER_GCAL_SYNC_INTERVAL", 15 * time.Minute, syncCalendars},
+}
+
+func (sc scheduledCheck) runPeriodically(db *bolt.DB) {
+	interval := sc.interval
+	if i := os.Getenv(sc.envVar); i != "" {
+		var err error
+		if interval, err = time.ParseDuration(i); err != nil {
+			slog.Error("Can't parse interval", "check", sc.name, "err", err)
+			return
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+
+	for {
+		// Each run gets an id of its own, as the checks share the daemon's
+		// log
+		runId := newRunId()
+		logger := slog.With("check", sc.name, "check_run", runId)
+		logger.Debug("Running scheduled check")
+		if err := trackRun(db, sc.name, runId, sc.run); err != nil {
+			logger.Error("Scheduled check failed", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"sort"
 	"text/tabwriter"
@@ -13,9 +14,11 @@ import (
 	"github.com/boltdb/bolt"
 )
 
+const summaryHeader = "Date\tStart\tEnd\tPad\t#Academy\t#Other\tType\n"
+
 func showSummary(db *bolt.DB, startToday, endTomorrow bool) {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-	fmt.Fprintf(w, "Date\tStart\tEnd\tPad\t#Academy\t#Other\tType\n")
+	fmt.Fprint(w, summaryHeader)
 	if err := db.View(func(tx *bolt.Tx) error {
 		c := tx.Cursor()
 
@@ -33,6 +36,9 @@ func showSummary(db *bolt.DB, startToday, endTomorrow bool) {
 		}
 
 		for day := firstDay; day != nil; day, _ = c.Next() {
+			if !isDayKey(day) {
+				continue
+			}
 			b := tx.Bucket(day)
 			evs := b.Bucket([]byte("events"))
 			if evs != nil {
@@ -48,7 +54,7 @@ func showSummary(db *bolt.DB, startToday, endTomorrow bool) {
 		}
 		return nil
 	}); err != nil {
-		log.Println("Can't summarise db:", err)
+		slog.Error("Can't summarise db", "err", err)
 	}
 
 	w.Flush()
@@ -61,28 +67,49 @@ type summary struct {
 	Academy   int
 	Other     int
 	Type      string
+
+	Product   ProductId
+	Cancelled bool
 }
 
 func summariseDay(w io.Writer, evs *bolt.Bucket, day string) {
+	writeSummaries(w, day, daySummaries(evs))
+}
+
+// daySummaries returns a summary of the most recent details of each
+// session in the events bucket, ordered by start time
+func daySummaries(evs *bolt.Bucket) []summary {
 	todaysEvents := []summary{}
 	evs.ForEach(func(sessionId, _ []byte) error {
 		_, evJson := evs.Bucket(sessionId).Cursor().Last()
-		ev := EventInfo{}
+		ev := timestampedEventInfo{}
 		if json.Unmarshal(evJson, &ev) == nil {
-			todaysEvents = append(todaysEvents, summary{
-				StartTime: ev.StartTime,
-				EndTime:   ev.EndTime,
-				Location:  ev.Location,
-				Academy:   ev.CapacityFreeAcademy - ev.AvailableFreeSpaces,
-				Other:     ev.TotalSpaces - ev.AvailableSpaces,
-				Type:      ev.ProductName})
+			s := summariseEvent(ev.EventInfo)
+			s.Product = ev.Product
+			s.Cancelled = ev.Cancelled
+			todaysEvents = append(todaysEvents, s)
 		}
 		return nil
 	})
 	sort.SliceStable(todaysEvents, func(i, j int) bool {
 		return todaysEvents[i].StartTime < todaysEvents[j].StartTime
 	})
-	for _, entry := range todaysEvents {
+	return todaysEvents
+}
+
+// summariseEvent works out the Academy and Other bookings for an event
+func summariseEvent(ev EventInfo) summary {
+	return summary{
+		StartTime: ev.StartTime,
+		EndTime:   ev.EndTime,
+		Location:  ev.Location,
+		Academy:   ev.CapacityFreeAcademy - ev.AvailableFreeSpaces,
+		Other:     ev.TotalSpaces - ev.AvailableSpaces,
+		Type:      ev.ProductName}
+}
+
+func writeSummaries(w io.Writer, day string, entries []summary) {
+	for _, entry := range entries {
 		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
 			day,
 			entry.StartTime, entry.EndTime, entry.Location,
@@ -92,3 +119,36 @@ func summariseDay(w io.Writer, evs *bolt.Bucket, day string) {
 		day = ""
 	}
 }
+
+// DaySummary holds the summaries for all sessions on a single day
+type DaySummary struct {
+	Day      string
+	Sessions []summary
+}
+
+// collectSummaries gathers summaries for each day with events from today
+// until the given number of days into the future
+func collectSummaries(db *bolt.DB, days int) ([]DaySummary, error) {
+	today := time.Now()
+	todayKey := []byte(fmt.Sprintf("%04d-%02d-%02d", today.Year(), today.Month(), today.Day()))
+	end := today.AddDate(0, 0, days)
+	endKey := []byte(fmt.Sprintf("%04d-%02d-%02d", end.Year(), end.Month(), end.Day()))
+
+	var summaries []DaySummary
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+		for day, _ := c.Seek(todayKey); day != nil && bytes.Compare(day, endKey) < 0; day, _ = c.Next() {
+			if !isDayKey(day) {
+				continue
+			}
+			evs := tx.Bucket(day).Bucket([]byte("events"))
+			if evs == nil {
+				continue
+			}
+			summaries = append(summaries, DaySummary{string(day), daySummaries(evs)})
+		}
+		return nil
+	})
+
+	return summaries, err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tokenStore represents the small json file used to persist tokens
+// between program runs, thus reducing the number of token requests
+// we need to make.  For user authentication, it also holds the refresh
+// token which lets us get new access tokens without asking again.
+type tokenStore struct {
+	Token        string
+	Validity     time.Time
+	RefreshToken string `json:",omitempty"`
+}
+
+// encryptedTokenStore is how the token store is written if a key is set
+// in ICESCRAPER_GCAL_TOKEN_KEY.  Ciphertext is the AES-GCM sealed json of
+// the tokenStore, prefixed with the nonce.
+type encryptedTokenStore struct {
+	Ciphertext []byte
+}
+
+// tokenStoreKey returns the encryption key from the environment, or nil
+// if the store isn't encrypted.  A base64 encoded 32 byte key is used
+// as is, and anything else is treated as a passphrase and hashed.
+func tokenStoreKey() []byte {
+	k := os.Getenv("ICESCRAPER_GCAL_TOKEN_KEY")
+	if k == "" {
+		return nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(k); err == nil && len(key) == 32 {
+		return key
+	}
+	sum := sha256.Sum256([]byte(k))
+	return sum[:]
+}
+
+func tokenStoreCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating token cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+func getStoredToken(file string) tokenStore {
+	unlock, err := lockTokenStore(file)
+	if err != nil {
+		slog.Warn("Stored token not locked", "err", err)
+		return tokenStore{}
+	}
+	defer unlock()
+
+	storeJson, err := ioutil.ReadFile(file)
+	if err != nil {
+		slog.Warn("Stored token not retrieved", "err", err)
+		return tokenStore{}
+	}
+
+	encrypted := encryptedTokenStore{}
+	if err := json.Unmarshal(storeJson, &encrypted); err != nil {
+		slog.Warn("Stored token file malformed", "err", err)
+		return tokenStore{}
+	}
+
+	if encrypted.Ciphertext != nil {
+		key := tokenStoreKey()
+		if key == nil {
+			slog.Warn("Stored token is encrypted but no key is set")
+			return tokenStore{}
+		}
+		aead, err := tokenStoreCipher(key)
+		if err != nil {
+			slog.Warn("Stored token not decryptable", "err", err)
+			return tokenStore{}
+		}
+		if len(encrypted.Ciphertext) < aead.NonceSize() {
+			slog.Warn("Stored token file malformed: too short")
+			return tokenStore{}
+		}
+		nonce, sealed := encrypted.Ciphertext[:aead.NonceSize()], encrypted.Ciphertext[aead.NonceSize():]
+		if storeJson, err = aead.Open(nil, nonce, sealed, nil); err != nil {
+			slog.Warn("Stored token not decryptable", "err", err)
+			return tokenStore{}
+		}
+	}
+
+	myTokenStore := tokenStore{}
+	if err := json.Unmarshal(storeJson, &myTokenStore); err != nil {
+		slog.Warn("Stored token file malformed", "err", err)
+		return tokenStore{}
+	}
+
+	return myTokenStore
+}
+
+// storeToken writes the token store atomically, readable only by us, so
+// that the token is never exposed or left half written
+func storeToken(file string, myTokenStore tokenStore) error {
+	storeJson, err := json.Marshal(myTokenStore)
+	if err != nil {
+		return errors.Wrap(err, "marshalling token store")
+	}
+
+	if key := tokenStoreKey(); key != nil {
+		aead, err := tokenStoreCipher(key)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return errors.Wrap(err, "generating nonce")
+		}
+		if storeJson, err = json.Marshal(encryptedTokenStore{aead.Seal(nonce, nonce, storeJson, nil)}); err != nil {
+			return errors.Wrap(err, "marshalling encrypted token store")
+		}
+	}
+
+	unlock, err := lockTokenStore(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating token store file")
+	}
+	defer os.Remove(f.Name())
+
+	// TempFile creates files with 0600 already, but make sure
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return errors.Wrap(err, "setting token store permissions")
+	}
+
+	if _, err := f.Write(storeJson); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing token store")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "syncing token store")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "closing token store")
+	}
+
+	if err := os.Rename(f.Name(), file); err != nil {
+		return errors.Wrap(err, "replacing token store")
+	}
+
+	return nil
+}
+
+// clearStoredToken removes the token store
+func clearStoredToken(file string) error {
+	unlock, err := lockTokenStore(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "removing token store")
+	}
+	return nil
+}
+
+// tokenLockTimeout is how long we wait for another process to finish
+// with the token store
+const tokenLockTimeout = 10 * time.Second
+
+// lockTokenStore takes a lock on the token store, with flock on a lock
+// file alongside it, and returns a function to release it.  The lock file
+// is left in place, as removing it would let another process lock a new
+// file while we still hold the old one.  A process which dies releases
+// its lock with its descriptors, so a lock is never left behind.
+func lockTokenStore(file string) (func(), error) {
+	lockFile := file + ".lock"
+	f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening token lock")
+	}
+
+	deadline := time.Now().Add(tokenLockTimeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return func() {
+				syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+				f.Close()
+			}, nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, errors.Wrap(err, "locking token store")
+		}
+
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, errors.Errorf("timed out waiting for token lock %v", lockFile)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenStoreLock(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token.json")
+	unlock, err := lockTokenStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan time.Time)
+	go func() {
+		unlock, err := lockTokenStore(file)
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		locked <- time.Now()
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	released := time.Now()
+	unlock()
+	if at := <-locked; at.Before(released) {
+		t.Errorf("token store locked again while still held")
+	}
+}
+
+func TestTokenStoreEncryption(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token.json")
+	want := tokenStore{"access", time.Now().Add(time.Hour).Round(0), "refresh"}
+
+	t.Setenv("ICESCRAPER_GCAL_TOKEN_KEY", "correct horse battery staple")
+	if err := storeToken(file, want); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "access") || strings.Contains(string(data), "refresh") {
+		t.Errorf("tokens stored in the clear: %s", data)
+	}
+	if got := getStoredToken(file); got.Token != want.Token || got.RefreshToken != want.RefreshToken || !got.Validity.Equal(want.Validity) {
+		t.Errorf("read back %+v, want %+v", got, want)
+	}
+
+	// Without the right key, nothing is read
+	for _, key := range []string{"wrong", ""} {
+		t.Setenv("ICESCRAPER_GCAL_TOKEN_KEY", key)
+		if got := getStoredToken(file); got != (tokenStore{}) {
+			t.Errorf("read %+v with key %q", got, key)
+		}
+	}
+}
+
+func TestTokenStoreFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "token.json")
+
+	for _, token := range []string{"first", "second"} {
+		if err := storeToken(file, tokenStore{Token: token}); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := fi.Mode().Perm(); mode != 0600 {
+			t.Errorf("token store has mode %v, want 0600", mode)
+		}
+		if got := getStoredToken(file); got.Token != token {
+			t.Errorf("read back %+v, want %v", got, token)
+		}
+	}
+
+	// If the store can't be replaced, the new one isn't left half written
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.MkdirAll(filepath.Join(blocked, "in-the-way"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeToken(blocked, tokenStore{Token: "third"}); err == nil {
+		t.Errorf("replacing a directory succeeded")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("%v left behind", e.Name())
+		}
+	}
+}
+
+func TestRevokeCommand(t *testing.T) {
+	fg, credFiles := newFakeGoogle(t, 1, false)
+	useFakeCalendar(t, fg)
+	tokenFile := filepath.Join(t.TempDir(), "token.json")
+	ga, err := NewAuthenticator(credFiles, tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ga.RevokeUri = fg.root + "/revoke"
+
+	saved := GCalClient
+	t.Cleanup(func() { GCalClient = saved })
+	GCalClient = &http.Client{Transport: ga}
+
+	if err := listFakeCalendar(t, GCalClient); err != nil {
+		t.Fatal(err)
+	}
+	token := getStoredToken(tokenFile).Token
+	if _, ok := fg.accessTokens[token]; !ok {
+		t.Fatalf("stored token %q wasn't granted", token)
+	}
+
+	if err := revokeCommand(); err != nil {
+		t.Fatalf("revoking: %v", err)
+	}
+	if _, ok := fg.accessTokens[token]; ok {
+		t.Errorf("token still valid after revoking")
+	}
+	if _, err := os.Stat(tokenFile); !os.IsNotExist(err) {
+		t.Errorf("token store still there after revoking: %v", err)
+	}
+}